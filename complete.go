@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gobs/readline"
+	"github.com/influxdb/influxdb/client"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// command keywords, derived from the handler regexes
+var keywords []string
+
+// looked up lazily on first completion, and refreshed by list db / list series.
+// cleared when we (re)connect, and when we write to or drop what's in them.
+var cachedDbs []string
+var cachedSeries []string
+var cachedColumns = make(map[string][]string)
+
+var reKeyword = regexp.MustCompile("^\\^([a-z ]+)")
+var reFrom = regexp.MustCompile("(?i)\\bfrom\\s+(\"[^\"]+\"|[^\\s;/]+)")
+
+// the literal words at the start of a handler regex, e.g. "^list series.*" -> "list series"
+func keywordOf(regex string) string {
+	m := reKeyword.FindStringSubmatch(regex)
+	if m == nil {
+		return ""
+	}
+	return strings.TrimSpace(m[1])
+}
+
+func initKeywords() {
+	seen := map[string]bool{"help": true, "commands": true, "exit": true}
+	for _, spec := range handlers {
+		if kw := keywordOf(spec.Match); kw != "" {
+			seen[kw] = true
+		}
+	}
+	keywords = make([]string, 0, len(seen))
+	for kw := range seen {
+		keywords = append(keywords, kw)
+	}
+	sort.Strings(keywords)
+}
+
+func initCompletion() {
+	// not breaking on \ and . lets us complete options and dotted series names
+	readline.SetCompleterDelims(" \t\n\"'`@$><=;|&{(,")
+	readline.SetAttemptedCompletionFunction(func(text string, start, end int) []string {
+		return completions(readline.GetLineBuffer(), start, text)
+	})
+}
+
+func withPrefix(candidates []string, prefix string) []string {
+	matches := make([]string, 0)
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
+
+// completions returns the candidates for word, which starts at offset start in line.
+func completions(line string, start int, word string) []string {
+	before := strings.ToLower(strings.TrimSpace(line[:start]))
+	fields := strings.Fields(before)
+
+	if len(fields) == 0 {
+		if strings.HasPrefix(word, "\\") {
+			opts := make([]string, len(options))
+			for i, opt := range options {
+				opts[i] = "\\" + opt
+			}
+			return withPrefix(opts, word)
+		}
+		return keywordCompletions(fields, word)
+	}
+
+	last := fields[len(fields)-1]
+	switch {
+	case before == "\\db" || before == "delete db" || before == "list users":
+		return withPrefix(getDbs(), word)
+	case before == "\\format":
+		return withPrefix(formats, word)
+	case before == "\\profile" || before == "writerc":
+		return withPrefix(profileNames(), word)
+	case last == "from" || last == "into" || before == "drop series":
+		return withPrefix(getSeries(), word)
+	case fields[0] == "select":
+		// the series can come before the word (where, group by) or after it (select list)
+		m := reFrom.FindStringSubmatch(line)
+		if m == nil {
+			return nil
+		}
+		return withPrefix(getColumns(strings.Trim(m[1], "\"")), word)
+	}
+	return keywordCompletions(fields, word)
+}
+
+// keywordCompletions completes multi-word keywords word by word
+func keywordCompletions(fields []string, word string) []string {
+	matches := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, kw := range keywords {
+		kwFields := strings.Fields(kw)
+		if len(kwFields) <= len(fields) {
+			continue
+		}
+		if strings.Join(kwFields[:len(fields)], " ") != strings.Join(fields, " ") {
+			continue
+		}
+		next := kwFields[len(fields)]
+		if strings.HasPrefix(next, word) && !seen[next] {
+			seen[next] = true
+			matches = append(matches, next)
+		}
+	}
+	return matches
+}
+
+// clearCompletionCache forgets everything we looked up, for when we connect to another server, db or profile
+func clearCompletionCache() {
+	cachedDbs = nil
+	cachedSeries = nil
+	cachedColumns = make(map[string][]string)
+}
+
+// forgetSeries is for when a series was written to or dropped:
+// it may have new columns, or be new or gone from the list.
+func forgetSeries(name string) {
+	delete(cachedColumns, name)
+	cachedSeries = nil
+}
+
+func getDbs() []string {
+	if cachedDbs == nil && cl != nil {
+		list, err := cl.GetDatabaseList()
+		if err != nil {
+			return nil
+		}
+		updateDbCache(list)
+	}
+	return cachedDbs
+}
+
+func updateDbCache(list []map[string]interface{}) {
+	cachedDbs = make([]string, 0, len(list))
+	for _, item := range list {
+		cachedDbs = append(cachedDbs, fmt.Sprint(item["name"]))
+	}
+}
+
+func getSeries() []string {
+	if cachedSeries == nil && cl != nil {
+		list_series, err := cl.Query("list series")
+		if err != nil {
+			return nil
+		}
+		updateSeriesCache(list_series)
+	}
+	return cachedSeries
+}
+
+// updateSeriesCache takes the result of an unfiltered list series query
+func updateSeriesCache(list_series []*client.Series) {
+	cachedSeries = make([]string, 0)
+	for _, series := range list_series {
+		for _, p := range series.Points {
+			cachedSeries = append(cachedSeries, fmt.Sprint(p[1]))
+		}
+	}
+}
+
+func getColumns(name string) []string {
+	cols, ok := cachedColumns[name]
+	if !ok && cl != nil {
+		series, err := cl.Query(fmt.Sprintf("select * from \"%s\" limit 1;", name))
+		if err != nil {
+			return nil
+		}
+		for _, serie := range series {
+			cols = append(cols, serie.Columns...)
+		}
+		cachedColumns[name] = cols
+	}
+	return cols
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/influxdb/influxdb/client"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// a batch of series that could not be written, one per line in the dead letter file
+type deadLetter struct {
+	TimePrecision client.TimePrecision `json:"time_precision"`
+	Series        []*client.Series     `json:"series"`
+}
+
+// retryBudget is the total time writeWithRetry waits between attempts
+func retryBudget() time.Duration {
+	budget := time.Duration(0)
+	wait := AsyncRetryWait
+	for i := 0; i < AsyncRetries; i++ {
+		budget += wait
+		wait *= 2
+	}
+	return budget
+}
+
+// writeWithRetry writes series, retrying with exponential backoff when it fails
+func writeWithRetry(series []*client.Series, precision client.TimePrecision) error {
+	wait := AsyncRetryWait
+	err := writeSeries(series, precision)
+	for i := 0; err != nil && i < AsyncRetries; i++ {
+		fmt.Fprintf(os.Stderr, "Failed to write %d series: %s. retrying in %s\n", len(series), err.Error(), wait)
+		time.Sleep(wait)
+		wait *= 2
+		err = writeSeries(series, precision)
+	}
+	return err
+}
+
+// writeDeadLetter appends the batch to the dead letter file, so it can be replayed later
+func writeDeadLetter(series []*client.Series, precision client.TimePrecision) error {
+	data, err := json.Marshal(deadLetter{precision, series})
+	if err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(path_deadletter, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fd, "%s\n", data)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+func replayDeadLetterHandler(cmd []string, out io.Writer) (*Timing, error) {
+	timings := makeTiming()
+	file := path_deadletter
+	if cmd[1] != "" {
+		file = strings.TrimSpace(cmd[1])
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		return timings, err
+	}
+	defer fd.Close()
+
+	replayed := 0
+	failed := 0
+	line := 0
+	reader := bufio.NewReader(fd)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return timings, err
+		}
+		if len(strings.TrimSpace(string(data))) > 0 {
+			line++
+			var batch deadLetter
+			dec := json.NewDecoder(strings.NewReader(string(data)))
+			// keep numbers as-is, so that large ints don't lose precision
+			dec.UseNumber()
+			if decErr := dec.Decode(&batch); decErr != nil {
+				fmt.Fprintf(os.Stderr, "%s:%d: %s\n", file, line, decErr.Error())
+				failed++
+			} else if writeErr := writeSeries(batch.Series, batch.TimePrecision); writeErr != nil {
+				fmt.Fprintf(os.Stderr, "%s:%d: %s\n", file, line, writeErr.Error())
+				failed++
+			} else {
+				replayed++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	timings.Executed = time.Now()
+	fmt.Fprintf(out, "replayed %d batches from %s, %d failed\n", replayed, file, failed)
+	timings.Printed = time.Now()
+	if failed > 0 {
+		return timings, fmt.Errorf("%d batches could not be replayed", failed)
+	}
+	return timings, nil
+}
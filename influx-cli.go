@@ -9,35 +9,29 @@ import (
 	"github.com/rcrowley/go-metrics"
 	//	"log"
 	"bufio"
+	"bytes"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"os/exec"
 	usr "os/user"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
-	"net/url"
 )
 
 // the following client methods are not implemented yet.
-// CreateDatabaseUser
-// ChangeDatabaseUser
-// UpdateDatabaseUser
-// UpdateDatabaseUserPermissions
-// DeleteDatabaseUser
-// GetDatabaseUserList
-// AlterDatabasePrivilege
+// ChangeDatabaseUser // combination of UpdateDatabaseUser, AlterDatabasePrivilege and UpdateDatabaseUserPermissions
 // AuthenticateClusterAdmin
-// GetShards // this returns LongTermShortTermShards which i think is not useful for >0.8
-
-// DropShardSpace
-// CreateShardSpace
-// DropShard
-// UpdateShardSpace
 
 // upto how many points to commit in 1 go?
 var AsyncCapacity = 1000
@@ -45,6 +39,11 @@ var AsyncCapacity = 1000
 // how long to wait max before flushing a commit payload
 var AsyncMaxWait = 500 * time.Millisecond
 
+// how many times to retry a failed async commit, and how long to wait before the first retry.
+// (the wait doubles for every subsequent retry)
+var AsyncRetries = 3
+var AsyncRetryWait = 100 * time.Millisecond
+
 var host, user, pass, db string
 var port int
 var cl *client.Client
@@ -53,19 +52,42 @@ var handlers []HandlerSpec
 var timing bool
 var dateTime bool
 var recordsOnly bool
+var border bool
+var expanded bool
+var format string
 var async bool
+var failFast bool
+var readOnly bool
+var scriptFile string
+var metricsOut string
+var metricsInterval time.Duration
+var metricsWriter MetricsWriter // nil unless -metrics-out is set
 var asyncInserts chan *client.Series
 var asyncInsertsCommitted chan int
+var asyncSpooled chan error // with a spool, the committer tells whether each insert made it to disk
 var forceInsertsFlush chan bool
 var sync_inserts_timer metrics.Timer
+var spool *Spool             // nil unless spoolDir is configured
+var asyncWriteFailures int64 // incremented by the committer, read by Exit(). use sync/atomic
 
-var path_rc, path_hist string
+var path_rc, path_hist, path_deadletter string
 
-type Handler func(cmd []string, out io.Writer) *Timing
+// a Handler executes a command and writes its output to out.
+// errors are returned, so that handle() can report them and keep track of failures
+type Handler func(cmd []string, out io.Writer) (*Timing, error)
+
+// Access tells whether a handler only reads, or also modifies data or settings on the server (or in ~/.influxrc)
+type Access int
+
+const (
+	Read Access = iota
+	Write
+)
 
 type HandlerSpec struct {
 	Match string
 	Handler
+	Access Access
 }
 
 type Timing struct {
@@ -100,81 +122,143 @@ var regexBind = "^bind"
 var regexConn = "^conn$"
 var regexCreateAdmin = "^create admin ([a-zA-Z0-9_-]+) (.+)"
 var regexCreateDb = "^create db ([a-zA-Z0-9_-]+)"
+var regexCreateShardSpace = "^create shardspace ([a-zA-Z0-9_-]+) ([a-zA-Z0-9_-]+) (.+)"
+var regexCreateUser = "^create user ([a-zA-Z0-9_-]+) (.+)"
 var regexDeleteAdmin = "^delete admin ([a-zA-Z0-9_-]+)"
 var regexDeleteDb = "^delete db ([a-zA-Z0-9_-]+)"
 var regexDeleteServer = "^delete server (.+)"
+var regexDeleteUser = "^delete user ([a-zA-Z0-9_-]+)"
 var regexDropSeries = "^drop series .+"
+var regexDropShard = "^drop shard ([0-9]+)((?: [0-9]+)*)$"
+var regexDropShardSpace = "^drop shardspace ([a-zA-Z0-9_-]+) ([a-zA-Z0-9_-]+)$"
 var regexEcho = "^echo (.+)"
+var regexGrantAdmin = "^grant admin ([a-zA-Z0-9_-]+)"
+var regexImportCsv = "^import csv ([^ \"]+|\"[^\"]+\") into ([a-zA-Z0-9_-]+|\"[^\"]+\")(?: columns \\(([^)]+)\\))?(?: time column ([^ ]+)(?: precision (s|ms|u))?)?$"
 var regexInsert = "^insert into ([a-zA-Z0-9_-]+) ?(\\(.+\\))? values \\((.*)\\)$"
 var regexInsertQuoted = "^insert into \"(.+)\" ?(\\(.+\\))? values \\((.*)\\)$"
 var regexListAdmin = "^list admin"
 var regexListDb = "^list db"
 var regexListSeries = "^list series.*"
 var regexListServers = "^list servers$"
+var regexListShards = "^list shards$"
 var regexListShardspaces = "^list shardspaces$"
-var regexOption = "^\\\\([a-z]+) ?([a-zA-Z0-9_-]+)?"
+var regexListUsers = "^list users ?([a-zA-Z0-9_-]+)?$"
+var regexOption = "^\\\\([a-z]+) ?(.+)?"
 var regexPing = "^ping$"
 var regexRaw = "^raw (.+)"
+var regexReplayDeadLetter = "^replay deadletter ?(.+)?$"
+var regexRevokeAdmin = "^revoke admin ([a-zA-Z0-9_-]+)"
 var regexSelect = "^select .*"
+var regexSource = "^source (.+)"
+var regexSetPermissions = "^set permissions ([a-zA-Z0-9_-]+) read '(.*)' write '(.*)'$"
 var regexUpdateAdmin = "^update admin ([a-zA-Z0-9_-]+) (.+)"
-var regexWriteRc = "^writerc"
+var regexUpdateShardSpace = "^update shardspace ([a-zA-Z0-9_-]+) ([a-zA-Z0-9_-]+) (.+)"
+var regexUpdateUser = "^update user ([a-zA-Z0-9_-]+) (.+)"
+var regexWriteRc = "^writerc(?: ([a-zA-Z0-9_-]+))?$"
 
 type Config struct {
-	Host          string
-	Port          int
-	User          string
-	Pass          string
-	Db            string
-	AsyncCapacity int
-	AsyncMaxWait  int
+	Host           string
+	Port           int
+	User           string
+	Pass           string
+	Db             string
+	AsyncCapacity  int
+	AsyncMaxWait   int
+	AsyncRetries   *int // a pointer, so we can tell 0 (don't retry) from unset
+	AsyncRetryWait int
+	DeadLetterFile string
+	SpoolDir       string
+	Profiles       map[string]Profile
+	UdpPort        int
+
+	Ssl                bool
+	CaCert             string
+	ClientCert         string
+	ClientKey          string
+	InsecureSkipVerify bool
 }
 
 func init() {
 	path_rc = Expand("~/.influxrc")
 	path_hist = Expand("~/.influx_history")
+	path_deadletter = Expand("~/.influx_deadletter")
 
 	flag.StringVar(&host, "host", "localhost", "host to connect to")
 	flag.IntVar(&port, "port", 8086, "port to connect to")
 	flag.StringVar(&user, "user", "root", "influxdb username")
-	flag.StringVar(&pass, "pass", "root", "influxdb password")
+	flag.StringVar(&pass, "pass", "root", "influxdb password. visible in ps and your shell history, consider -pass-prompt, -pass-file or INFLUX_PASSWORD instead")
+	flag.StringVar(&passFile, "pass-file", "", "read the influxdb password from the given file")
+	flag.BoolVar(&passPrompt, "pass-prompt", false, "prompt for the influxdb password")
 	flag.StringVar(&db, "db", "", "database to use")
+	flag.StringVar(&profile, "profile", "", "use the connection parameters of the given profile in ~/.influxrc")
+	flag.BoolVar(&ssl, "ssl", false, "connect over https")
+	flag.BoolVar(&readOnly, "readonly", false, "only allow commands that read, reject those that write (inserts, create/update/delete, drop, writerc, raw)")
+	flag.BoolVar(&assumeYes, "yes", false, "don't ask to confirm destructive commands (delete db, drop series, delete admin, delete server)")
+	flag.IntVar(&udpPort, "udp-port", 0, "send inserts to the server's udp listener on this port (toggle with \\udp)")
+	flag.StringVar(&caCert, "ca-cert", "", "with -ssl: pem file with the CA certificate(s) to verify the server against, instead of the system ones")
+	flag.StringVar(&clientCert, "client-cert", "", "with -ssl: pem file with the client certificate to authenticate with (requires -client-key)")
+	flag.StringVar(&clientKey, "client-key", "", "with -ssl: pem file with the private key for -client-cert")
+	flag.BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "with -ssl: don't verify the server certificate. insecure!")
 	flag.BoolVar(&recordsOnly, "recordsOnly", false, "when enabled, doesn't display header")
 	flag.BoolVar(&async, "async", false, "when enabled, asynchronously flushes inserts")
+	flag.BoolVar(&border, "border", false, "when enabled, draws borders around tables")
+	flag.StringVar(&scriptFile, "f", "", "execute the statements in the given file before anything else")
+	flag.BoolVar(&failFast, "fail-fast", false, "stop executing a script or stdin at the first failing statement, and exit with status 1")
+	flag.StringVar(&format, "format", "table", "output format: table, csv, json or ndjson")
+	flag.StringVar(&metricsOut, "metrics-out", "", "periodically write metrics to tcp://host:port (graphite plaintext) or to a file (json lines)")
+	flag.DurationVar(&metricsInterval, "metrics-interval", 10*time.Second, "how often to write metrics to -metrics-out")
 
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage: influx-cli [flags] [query to execute on start]")
 		fmt.Fprintf(os.Stderr, "\nFlags:\n")
 		flag.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nNote: you can also pipe queries into stdin, one line per query\n")
+		fmt.Fprintf(os.Stderr, "\nNote: you can also pipe queries into stdin, one statement per line (select statements can span multiple lines, and end at the ;)\n")
 	}
 
 	handlers = []HandlerSpec{
-		HandlerSpec{regexBind, bindHandler},
-		HandlerSpec{regexConn, connHandler},
-		HandlerSpec{regexCreateAdmin, createAdminHandler},
-		HandlerSpec{regexCreateDb, createDbHandler},
-		HandlerSpec{regexDeleteAdmin, deleteAdminHandler},
-		HandlerSpec{regexDeleteDb, deleteDbHandler},
-		HandlerSpec{regexDeleteServer, deleteServerHandler},
-		HandlerSpec{regexDropSeries, dropSeriesHandler},
-		HandlerSpec{regexEcho, echoHandler},
-		HandlerSpec{regexInsert, insertHandler},
-		HandlerSpec{regexInsertQuoted, insertHandler},
-		HandlerSpec{regexListAdmin, listAdminHandler},
-		HandlerSpec{regexListDb, listDbHandler},
-		HandlerSpec{regexListSeries, listSeriesHandler},
-		HandlerSpec{regexListServers, listServersHandler},
-		HandlerSpec{regexListShardspaces, listShardspacesHandler},
-		HandlerSpec{regexOption, optionHandler},
-		HandlerSpec{regexPing, pingHandler},
-		HandlerSpec{regexRaw, rawHandler},
-		HandlerSpec{regexSelect, selectHandler},
-		HandlerSpec{regexUpdateAdmin, updateAdminPassHandler},
-		HandlerSpec{regexWriteRc, writeRcHandler},
-	}
+		HandlerSpec{regexBind, bindHandler, Read},
+		HandlerSpec{regexConn, connHandler, Read},
+		HandlerSpec{regexCreateAdmin, createAdminHandler, Write},
+		HandlerSpec{regexCreateDb, createDbHandler, Write},
+		HandlerSpec{regexCreateShardSpace, createShardSpaceHandler, Write},
+		HandlerSpec{regexCreateUser, createUserHandler, Write},
+		HandlerSpec{regexDeleteAdmin, deleteAdminHandler, Write},
+		HandlerSpec{regexDeleteDb, deleteDbHandler, Write},
+		HandlerSpec{regexDeleteServer, deleteServerHandler, Write},
+		HandlerSpec{regexDeleteUser, deleteUserHandler, Write},
+		HandlerSpec{regexDropSeries, dropSeriesHandler, Write},
+		HandlerSpec{regexDropShard, dropShardHandler, Write},
+		HandlerSpec{regexDropShardSpace, dropShardSpaceHandler, Write},
+		HandlerSpec{regexEcho, echoHandler, Read},
+		HandlerSpec{regexGrantAdmin, grantAdminHandler, Write},
+		HandlerSpec{regexImportCsv, importCsvHandler, Write},
+		HandlerSpec{regexInsert, insertHandler, Write},
+		HandlerSpec{regexInsertQuoted, insertHandler, Write},
+		HandlerSpec{regexListAdmin, listAdminHandler, Read},
+		HandlerSpec{regexListDb, listDbHandler, Read},
+		HandlerSpec{regexListSeries, listSeriesHandler, Read},
+		HandlerSpec{regexListServers, listServersHandler, Read},
+		HandlerSpec{regexListShards, listShardsHandler, Read},
+		HandlerSpec{regexListShardspaces, listShardspacesHandler, Read},
+		HandlerSpec{regexListUsers, listUsersHandler, Read},
+		HandlerSpec{regexOption, optionHandler, Read},
+		HandlerSpec{regexPing, pingHandler, Read},
+		HandlerSpec{regexRaw, rawHandler, Write},
+		HandlerSpec{regexReplayDeadLetter, replayDeadLetterHandler, Write},
+		HandlerSpec{regexRevokeAdmin, revokeAdminHandler, Write},
+		HandlerSpec{regexSelect, selectHandler, Read},
+		HandlerSpec{regexSetPermissions, setPermissionsHandler, Write},
+		HandlerSpec{regexSource, sourceHandler, Read},
+		HandlerSpec{regexUpdateAdmin, updateAdminPassHandler, Write},
+		HandlerSpec{regexUpdateShardSpace, updateShardSpaceHandler, Write},
+		HandlerSpec{regexUpdateUser, updateUserPassHandler, Write},
+		HandlerSpec{regexWriteRc, writeRcHandler, Write},
+	}
+	initKeywords()
 
 	asyncInserts = make(chan *client.Series)
 	asyncInsertsCommitted = make(chan int)
+	asyncSpooled = make(chan error)
 	forceInsertsFlush = make(chan bool)
 
 	sync_inserts_timer = metrics.NewTimer()
@@ -187,16 +271,31 @@ func printHelp() {
 options & current session
 -------------------------
 
+\border          : toggle borders around tables
 \dt              : print timestamps as datetime strings
 \r               : show records only, no headers
+\format <fmt>    : set output format: table (default), csv, json or ndjson
+\x               : toggle expanded display: one "column | value" line per column.
+                   you can also end a single statement with \G instead of ;
 \t               : toggle timing, which displays timing of
                    query execution + network and output displaying
                    (default: false)
+\stats           : show timers and counters: queries run, rows returned,
+                   calls, errors and read-only refusals per command, async insert batches
 \async           : asynchronously flush inserts
+\udp             : toggle sending inserts over udp (requires -udp-port)
+\failfast        : toggle stopping scripts (source, \i, -f, stdin) at the first failing statement
+\readonly        : toggle read-only mode, which refuses all commands that write:
+                   inserts, imports, create/update/delete, grant/revoke, drop, set permissions,
+                   select ... into, replay deadletter, writerc and raw
+\safe            : toggle safe mode, which refuses destructive commands
+                   (delete db, drop series, delete admin, delete server).
+                   outside of safe mode, they ask for confirmation when interactive, unless -yes is given
 \comp            : disable compression (client lib doesn't support enabling)
 \db <db>         : switch to databasename (requires a bind call to be effective)
 \user <username> : switch to different user (requires a bind call to be effective)
 \pass <password> : update password (requires a bind call to be effective)
+\profile <name>  : switch to the given profile from ~/.influxrc, and bind
 
 bind             : bind again, possibly after updating db, user or pass
 ping             : ping the server
@@ -214,6 +313,15 @@ create db <name>                : create database
 delete db <name>                : drop database
 list db                         : list databases
 
+create user <user> <pass>       : add given user to the current database
+delete user <user>              : delete user from the current database
+update user <user> <pass>       : update the password for given database user
+grant admin <user>              : make given user a database admin
+revoke admin <user>             : revoke database admin rights of given user
+set permissions <user> read '<regex>' write '<regex>'
+                                : set read and write permissions of given user (regexes on series names)
+list users [db]                 : list users of the current (or given) database
+
 list series [/regex/[i]]        : list series, optionally filtered by regex
 drop series <name>              : drop series by given name
 
@@ -221,16 +329,37 @@ delete server <id>              : delete server by id
 list servers                    : list servers
 
 list shardspaces                : list shardspaces
+create shardspace <db> <name> regex '<regex>' [retention <d>] [duration <d>] [replication <n>] [split <n>]
+                                : create shardspace. options not given use the server defaults
+update shardspace <db> <name> [regex '<regex>'] [retention <d>] [duration <d>] [replication <n>] [split <n>]
+                                : update the given options of a shardspace
+drop shardspace <db> <name>     : drop shardspace
+
+list shards                     : list shards
+drop shard <id> [<server id> ...]
+                                : drop shard from the given servers, or from all servers it's on
 
 
 data i/o
 --------
 
-insert into <name> [(col1[,col2[...]])] values (val1[,val2[,val3[...]]])
+insert into <name> [(col1[,col2[...]])] values (val1[,val2[,val3[...]]])[,(val1[,...])[...]]
                            : insert values into the given columns for given series name.
+                             multiple tuples of values are sent as multiple points.
                              columns is optional and defaults to (time, sequence_number, value)
-                             (timestamp is assumed to be in ms. ms/u/s prefixes don't work yet)
-select ...                 : select statement for data retrieval
+                             time can be a number in ms, or suffixed with s, ms or u (e.g. 1406231160s),
+                             an RFC3339 timestamp, now() or now() +/- a duration (e.g. now() - 1h)
+import csv <file> into <name> [columns (col1[,col2[...]])] [time column <col> [precision <s|ms|u>]]
+                           : bulk import a csv file into the given series name.
+                             quote the file name if it contains spaces.
+                             without columns, the first line of the file is the header.
+                             the time column gets renamed to time, precision defaults to ms.
+                             batches of asyncCapacity points are written at once,
+                             or handed to the async committer if async is enabled.
+select ...                 : select statement for data retrieval.
+                             can span multiple lines, and must be terminated with ; (or \G)
+replay deadletter [<file>] : resend async inserts that failed after all retries.
+                             (default file: ~/.influx_deadletter, or deadLetterFile in ~/.influxrc)
 
 
 misc
@@ -240,7 +369,10 @@ conn             : display info about current connection
 raw <str>        : execute query raw (fallback for unsupported queries)
 echo <str>       : echo string + newline.
                    this is useful when the input is not visible, i.e. from scripts
-writerc          : write current parameters to ~/.influxrc file
+source <file>    : execute all statements in the given file. (\i <file> does the same)
+writerc [<name>] : save current connection parameters to ~/.influxrc,
+                   as profile <name>, or the active profile (default: top level).
+                   other settings in the file are kept.
 commands         : this menu
 help             : this menu
 exit / ctrl-D    : exit the program
@@ -248,11 +380,15 @@ exit / ctrl-D    : exit the program
 modifiers
 ---------
 
+select statements must end with ; or \G. other commands end at the end of the line,
+so they don't need one, unless the line ends inside parens or with a trailing comma.
+
 ANY command above can be subject to piping to another command or writing output to a file, like so:
 
 command; | <command>     : pipe the output into an external command (example: list series; | sort)
                            note: currently you can only pipe into one external command at a time
 command; > <filename>    : redirect the output into a file
+command\G [| or >] ...   : like ;, but display the results in expanded mode (see \x)
 
 `
 	fmt.Println(out)
@@ -264,8 +400,15 @@ func getClient() error {
 		Username: user,
 		Password: pass,
 		Database: db,
+		IsSecure: ssl,
 	}
 	var err error
+	if ssl {
+		cfg.HttpClient, err = newHttpsClient()
+		if err != nil {
+			return err
+		}
+	}
 	cl, err = client.NewClient(cfg)
 	if err != nil {
 		return err
@@ -275,11 +418,12 @@ func getClient() error {
 		return err
 	}
 	//fmt.Printf("connected to %s:%s@%s:%d/%s\n", user, pass, host, port, db)
-	return nil
+	clearCompletionCache()
+	return getUdpClient()
 }
 
 func Expand(in string) (out string) {
-	if in[:1] == "~" {
+	if strings.HasPrefix(in, "~") {
 		cur_usr, err := usr.Current()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, err.Error()+"\n")
@@ -291,19 +435,8 @@ func Expand(in string) (out string) {
 	return in
 }
 
-func main() {
-	var conf Config
-	if _, err := os.Stat(path_rc); err == nil {
-		if _, err := toml.DecodeFile(path_rc, &conf); err != nil {
-			fmt.Fprintf(os.Stderr, err.Error()+"\n")
-			os.Exit(2)
-		}
-	} else if !os.IsNotExist(err) {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		os.Exit(2)
-	}
-	// else, rc doesn't exist, which is fine.
-
+// applyConfig applies the settings from the influxrc, over the defaults
+func applyConfig(conf Config) {
 	if conf.Host != "" {
 		host = conf.Host
 	}
@@ -325,26 +458,123 @@ func main() {
 	if conf.AsyncMaxWait > 0 {
 		AsyncMaxWait = time.Duration(conf.AsyncMaxWait) * time.Millisecond
 	}
+	if conf.AsyncRetries != nil && *conf.AsyncRetries >= 0 {
+		AsyncRetries = *conf.AsyncRetries
+	}
+	if conf.AsyncRetryWait > 0 {
+		AsyncRetryWait = time.Duration(conf.AsyncRetryWait) * time.Millisecond
+	}
+	if conf.DeadLetterFile != "" {
+		path_deadletter = Expand(conf.DeadLetterFile)
+	}
+	if conf.SpoolDir != "" {
+		spoolDir = Expand(conf.SpoolDir)
+	}
+	if conf.UdpPort != 0 {
+		udpPort = conf.UdpPort
+	}
+	if conf.Ssl {
+		ssl = true
+	}
+	if conf.CaCert != "" {
+		caCert = conf.CaCert
+	}
+	if conf.ClientCert != "" {
+		clientCert = conf.ClientCert
+	}
+	if conf.ClientKey != "" {
+		clientKey = conf.ClientKey
+	}
+	if conf.InsecureSkipVerify {
+		insecureSkipVerify = true
+	}
+	profiles = conf.Profiles
+	baseConn = Profile{host, port, user, pass, db}
+}
+
+func main() {
+	var conf Config
+	if _, err := os.Stat(path_rc); err == nil {
+		if _, err := toml.DecodeFile(path_rc, &conf); err != nil {
+			fmt.Fprintf(os.Stderr, err.Error()+"\n")
+			os.Exit(2)
+		}
+	} else if !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, err.Error()+"\n")
+		os.Exit(2)
+	}
+	// else, rc doesn't exist, which is fine.
+
+	applyConfig(conf)
 
 	flag.Parse()
 	query := strings.Join(flag.Args(), " ")
 
+	// explicit commandline args take precedence over INFLUX_PASSWORD and the profile
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if err := resolveConn(explicit); err != nil {
+		fmt.Fprintf(os.Stderr, err.Error()+"\n")
+		os.Exit(2)
+	}
+
+	if !validFormat(format) {
+		fmt.Fprintf(os.Stderr, "unrecognized format %q. must be one of %s\n", format, strings.Join(formats, ", "))
+		os.Exit(2)
+	}
+	udp = udpPort != 0
+	if metricsInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "metrics-interval must be positive\n")
+		os.Exit(2)
+	}
+
 	err := getClient()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, err.Error()+"\n")
 		os.Exit(1)
 	}
 
+	if spoolDir != "" {
+		spool, err = OpenSpool(spoolDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open spool: %s\n", err.Error())
+			os.Exit(1)
+		}
+		err = recoverSpool(spool)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot recover spool: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
 	//go metrics.Log(metrics.DefaultRegistry, 10e9, log.New(os.Stderr, "metrics: ", log.Lmicroseconds))
+	if metricsOut != "" {
+		metricsWriter, err = newMetricsWriter(metricsOut)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open metrics output: %s\n", err.Error())
+			os.Exit(1)
+		}
+		go exportMetrics(metricsWriter, metrics.DefaultRegistry, metricsInterval)
+	}
 	go committer()
 
+	// for non-interactive use, our exit code reflects whether all commands succeeded
+	ok := true
+	if scriptFile != "" {
+		ok = runScript(scriptFile)
+		if !ok && failFast {
+			Exit(1)
+		}
+	}
+
 	if query != "" {
 		// execute query passed from cmd arg and stop
 		cmd := strings.TrimSuffix(strings.TrimSpace(query), ";")
-		handle(cmd)
+		interactive = termutil.Isatty(os.Stdin.Fd())
+		ok = handle(cmd) && ok
 	} else if !termutil.Isatty(os.Stdin.Fd()) {
 		// execute all input from stdin and stop
-		readStdin()
+		ok = readStdin() && ok
 	} else {
 		// if stdin is a tty, provide readline prompt with history.
 		err = readline.ReadHistoryFile(path_hist)
@@ -352,6 +582,8 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Cannot read '%s': %s\n", path_hist, err.Error())
 			os.Exit(1)
 		}
+		initCompletion()
+		interactive = true
 		ui()
 		err = readline.WriteHistoryFile(path_hist)
 		if err != nil {
@@ -359,68 +591,259 @@ func main() {
 			Exit(1)
 		}
 	}
+	if !ok {
+		Exit(1)
+	}
 	Exit(0)
 }
+
+// exitTimeout is how long Exit waits for the final async inserts.
+// besides the final commit, another one may be in progress, and each can take the full retry budget.
+func exitTimeout() time.Duration {
+	return 5*time.Second + 2*retryBudget()
+}
+
 func Exit(code int) {
 	close(asyncInserts)
 	select {
-	case <-time.After(time.Second * 5):
+	case <-time.After(exitTimeout()):
 		fmt.Fprintf(os.Stderr, "Could not flush all inserts.  Closing anyway")
+		if spool != nil {
+			fmt.Fprintf(os.Stderr, "\nThe pending inserts are kept in %s and will be resent on next start", spool.path)
+		}
 	case num := <-asyncInsertsCommitted:
 		if num > 0 {
 			fmt.Printf("Final %d async inserts committed\n", num)
 		}
 	}
+	if metricsWriter != nil {
+		// so short runs get exported too, and longer ones include the final inserts
+		err := metricsWriter(metrics.DefaultRegistry, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not export metrics: %s\n", err.Error())
+		}
+	}
+	if failures := atomic.LoadInt64(&asyncWriteFailures); failures > 0 && code == 0 {
+		fmt.Fprintf(os.Stderr, "%d async writes failed\n", failures)
+		code = 1
+	}
 	os.Exit(code)
 }
 
-func readStdin() {
+// StatementBuffer assembles statements that span multiple lines.
+// a statement is complete when it's terminated by ; or \G (outside of quotes).
+// for backwards compatibility, commands other than select can omit the terminator,
+// as long as they don't end in an open paren or a trailing comma.
+// only selects can continue across lines inside quotes, for other commands a quote is just a character,
+// like in "echo it's done". a line that starts a new command also completes any pending statement,
+// unless it's inside the quotes of a select. a backslash option always does, so you can't get stuck.
+type StatementBuffer struct {
+	lines []string
+	num   int // number of lines seen so far
+	start int // line number where the pending statement started
+}
+
+// Statement is a complete statement, along with the line number it started on
+type Statement struct {
+	Text string
+	Line int
+}
+
+// Add adds a line of input and returns the statements it completes
+func (b *StatementBuffer) Add(line string) []Statement {
+	line = strings.TrimSpace(line)
+	b.num++
+	done := make([]Statement, 0, 1)
+	if b.Pending() && startsCommand(line) {
+		_, _, quote, _ := scanStatement(b.String())
+		if quote == 0 || !isSelect(b.String()) || strings.HasPrefix(line, "\\") {
+			done = append(done, b.FlushStatement())
+		}
+	}
+	if line == "" {
+		return done
+	}
+	if !b.Pending() {
+		b.start = b.num
+	}
+	b.lines = append(b.lines, line)
+	if statementComplete(b.String()) {
+		done = append(done, b.FlushStatement())
+	}
+	return done
+}
+
+func (b *StatementBuffer) Pending() bool {
+	return len(b.lines) > 0
+}
+
+func (b *StatementBuffer) String() string {
+	return strings.Join(b.lines, " ")
+}
+
+// Flush returns the buffered statement, complete or not, and resets the buffer
+func (b *StatementBuffer) Flush() string {
+	return b.FlushStatement().Text
+}
+
+func (b *StatementBuffer) FlushStatement() Statement {
+	stmt := Statement{b.String(), b.start}
+	b.lines = nil
+	return stmt
+}
+
+func startsCommand(line string) bool {
+	if strings.HasPrefix(line, "\\") {
+		return true
+	}
+	fields := strings.Fields(strings.ToLower(line))
+	if len(fields) == 0 {
+		return false
+	}
+	for _, kw := range keywords {
+		if strings.Fields(kw)[0] == fields[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// scanStatement reports whether stmt contains a ; outside of quotes,
+// the paren depth and open quote character (if any) at the end, and the last
+// character outside of quotes.
+func scanStatement(stmt string) (terminated bool, depth int, quote byte, last byte) {
+	for i := 0; i < len(stmt); i++ {
+		c := stmt[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'':
+			quote = c
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ';':
+			terminated = true
+		}
+		if c != ' ' && c != '\t' {
+			last = c
+		}
+	}
+	return
+}
+
+func isSelect(stmt string) bool {
+	return strings.HasPrefix(strings.ToLower(stmt), "select ")
+}
+
+func statementComplete(stmt string) bool {
+	terminated, depth, quote, last := scanStatement(stmt)
+	if !isSelect(stmt) {
+		// the terminator is optional here, and an unbalanced quote doesn't hold the statement
+		return terminated || depth <= 0 && last != ','
+	}
+	if quote != 0 {
+		return false
+	}
+	if terminated {
+		return true
+	}
+	_, vertical := parseVerticalTerminator(stmt)
+	return vertical
+}
+
+// readStdin executes all statements from stdin, and returns whether they all succeeded.
+// with failFast, it stops at the first one that fails.
+func readStdin() bool {
 	reader := bufio.NewReader(os.Stdin)
+	var buf StatementBuffer
+	ok := true
 	for {
 		line, err := reader.ReadString('\n')
-		if err == io.EOF {
-			return
-		}
-		if err != nil {
+		if err != nil && err != io.EOF {
 			fmt.Fprintln(os.Stderr, err.Error())
 			Exit(2)
 		}
-		cmd := strings.TrimSpace(line)
-		handle(cmd)
+		stmts := buf.Add(line)
+		if err == io.EOF && buf.Pending() {
+			stmts = append(stmts, buf.FlushStatement())
+		}
+		for _, stmt := range stmts {
+			if !handle(stmt.Text) {
+				ok = false
+				if failFast {
+					fmt.Fprintf(os.Stderr, "stdin:%d: stopping at first error\n", stmt.Line)
+					return false
+				}
+			}
+		}
+		if err == io.EOF {
+			return ok
+		}
 	}
 }
 
 func ui() {
 	prompt := "influx> "
+	contPrompt := "influx-> "
+	var buf StatementBuffer
 L:
 	for {
-		switch result := readline.ReadLine(&prompt); true {
-		case result == nil:
+		p := &prompt
+		if buf.Pending() {
+			p = &contPrompt
+		}
+		result := readline.ReadLine(p)
+		var stmts []Statement
+		if result == nil {
 			fmt.Println("")
+			if !buf.Pending() {
+				break L
+			}
+			// like at the end of stdin, we execute an unterminated statement rather than dropping it
+			stmts = []Statement{buf.FlushStatement()}
+		} else {
+			stmts = buf.Add(*result)
+		}
+		for _, stmt := range stmts {
+			if !hasCredentials(stmt.Text) {
+				readline.AddHistory(stmt.Text)
+			}
+			switch strings.TrimSuffix(stmt.Text, ";") {
+			case "exit":
+				break L
+			case "commands", "help":
+				printHelp()
+			default:
+				handle(stmt.Text)
+			}
+		}
+		if result == nil {
 			break L
-		case *result == "exit":
-			readline.AddHistory(*result)
-			break L
-		case *result == "commands":
-			readline.AddHistory(*result)
-			printHelp()
-		case *result == "help":
-			readline.AddHistory(*result)
-			printHelp()
-		case *result != "": //ignore blank lines
-			readline.AddHistory(*result)
-			cmd := strings.TrimSpace(*result)
-			handle(cmd)
 		}
 	}
 }
 
-func handle(cmd string) {
+// handle executes a command, and returns whether it could be executed successfully
+func handle(cmd string) bool {
 	handled := false
+	failed := false
 	var writeTo io.WriteCloser
 	var pipeTo *exec.Cmd
 	writeTo = os.Stdout
 	mode := 0 // 1 -> pipe to cmd, 2 -> write to file
+
+	cmd, vertical := parseVerticalTerminator(cmd)
+	if vertical && !expanded {
+		expanded = true
+		defer func() { expanded = false }()
+	}
+
 	cmd = strings.Replace(cmd, "; |", ";|", 1)
 	cmd = strings.Replace(cmd, "; >", ";>", 1)
 
@@ -471,12 +894,30 @@ func handle(cmd string) {
 					break
 				}
 			}
-			t := spec.Handler(matches, writeTo)
+			var t *Timing
+			var err error
+			if readOnly && spec.Access == Write {
+				// don't echo the command, it may contain a password
+				name := keywordOf(spec.Match)
+				if name == "" {
+					name = handlerName(spec.Handler)
+				}
+				err = fmt.Errorf("refusing to run %s in read-only mode. use \\readonly to toggle", name)
+				countRefused(statsName(spec, matches))
+			} else {
+				t, err = spec.Handler(matches, writeTo)
+				countHandler(statsName(spec, matches), err)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				failed = true
+			}
 			if mode == 1 {
 				writeTo.Close()
 				err := pipeTo.Wait()
 				if err != nil {
 					fmt.Fprintln(os.Stderr, "subcommand failed: ", err.Error())
+					failed = true
 				}
 			}
 
@@ -493,9 +934,106 @@ func handle(cmd string) {
 	if !handled {
 		fmt.Fprintln(os.Stderr, "Could not handle the command. type 'help' to get a help menu")
 	}
+	return handled && !failed
+}
+
+// the scripts that are being executed, so a script that (indirectly) sources itself doesn't recurse forever
+var runningScripts = make(map[string]bool)
+
+// runScript feeds all statements in the given file through handle.
+// it returns false if any statement failed. (with failFast, it stops at the first one)
+func runScript(file string) bool {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return false
+	}
+	if runningScripts[abs] {
+		fmt.Fprintf(os.Stderr, "%s: already being executed. not sourcing it recursively\n", file)
+		return false
+	}
+	runningScripts[abs] = true
+	defer delete(runningScripts, abs)
+	// also when sourced from the prompt, a script runs unattended
+	defer func(i bool) { interactive = i }(interactive)
+	interactive = false
+	fd, err := os.Open(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return false
+	}
+	defer fd.Close()
+	ok := true
+	reader := bufio.NewReader(fd)
+	var buf StatementBuffer
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, err.Error())
+			return false
+		}
+		stmts := buf.Add(line)
+		if err == io.EOF && buf.Pending() {
+			stmts = append(stmts, buf.FlushStatement())
+		}
+		for _, stmt := range stmts {
+			if !handle(stmt.Text) {
+				fmt.Fprintf(os.Stderr, "%s:%d: failed statement: %s\n", file, stmt.Line, stmt.Text)
+				ok = false
+				if failFast {
+					fmt.Fprintf(os.Stderr, "%s: stopping at first error\n", file)
+					return false
+				}
+			}
+		}
+		if err == io.EOF {
+			return ok
+		}
+	}
+}
+
+func sourceHandler(cmd []string, out io.Writer) (*Timing, error) {
+	return nil, sourceFile(strings.TrimSpace(cmd[1]))
+}
+
+func sourceFile(file string) error {
+	if !runScript(file) {
+		return fmt.Errorf("%s: not all statements executed successfully", file)
+	}
+	return nil
+}
+
+// a statement terminated by \G instead of ; (optionally followed by a modifier)
+// displays its results in expanded mode. parseVerticalTerminator rewrites it
+// to a regular ; terminated statement.
+// only the last \G that ends the statement counts, others may be part of a string or /regex/.
+var reVerticalTerminator = regexp.MustCompile("^(.*)\\\\G\\s*([|>].*)?$")
+
+func parseVerticalTerminator(cmd string) (string, bool) {
+	m := reVerticalTerminator.FindStringSubmatch(cmd)
+	if m == nil {
+		return cmd, false
+	}
+	return m[1] + ";" + m[2], true
 }
 
-func optionHandler(cmd []string, out io.Writer) *Timing {
+// singleArg returns the argument of an option that takes exactly one word.
+// (unlike \i and \format, which take the rest of the line)
+func singleArg(arg, what string) (string, error) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("%s argument must be set", what)
+	}
+	if len(fields) > 1 {
+		return "", fmt.Errorf("%s argument must be a single word, got %q", what, arg)
+	}
+	return fields[0], nil
+}
+
+// all options handled by optionHandler, for completion
+var options = []string{"async", "border", "comp", "db", "dt", "failfast", "format", "i", "pass", "profile", "r", "readonly", "safe", "stats", "t", "udp", "user", "x"}
+
+func optionHandler(cmd []string, out io.Writer) (*Timing, error) {
 	switch cmd[1] {
 	case "async":
 		if async {
@@ -505,12 +1043,50 @@ func optionHandler(cmd []string, out io.Writer) *Timing {
 		}
 		async = !async
 		fmt.Fprintln(out, "async is now", async)
+	case "border":
+		border = !border
+		fmt.Fprintln(out, "table borders are now", border)
 	case "dt":
 		dateTime = !dateTime
 		fmt.Fprintln(out, "datetime printing is now", dateTime)
 	case "r":
 		recordsOnly = !recordsOnly
 		fmt.Fprintln(out, "records-only is now", recordsOnly)
+	case "format":
+		if cmd[2] == "" {
+			fmt.Fprintln(out, "format is", format)
+			break
+		}
+		if !validFormat(cmd[2]) {
+			return nil, fmt.Errorf("unrecognized format %q. must be one of %s", cmd[2], strings.Join(formats, ", "))
+		}
+		format = cmd[2]
+		fmt.Fprintln(out, "format is now", format)
+	case "x":
+		expanded = !expanded
+		fmt.Fprintln(out, "expanded display is now", expanded)
+	case "udp":
+		if udpCl == nil {
+			return nil, errors.New("udp needs a udp port. use -udp-port or udpPort in ~/.influxrc")
+		}
+		udp = !udp
+		fmt.Fprintln(out, "udp inserts are now", udp)
+	case "readonly":
+		readOnly = !readOnly
+		fmt.Fprintln(out, "read-only mode is now", readOnly)
+	case "safe":
+		safe = !safe
+		fmt.Fprintln(out, "safe mode is now", safe)
+	case "failfast":
+		failFast = !failFast
+		fmt.Fprintln(out, "fail-fast is now", failFast)
+	case "i":
+		if cmd[2] == "" {
+			return nil, errors.New("file argument must be set")
+		}
+		return nil, sourceFile(strings.TrimSpace(cmd[2]))
+	case "stats":
+		return nil, printList(out, statsSeries(metrics.DefaultRegistry))
 	case "t":
 		timing = !timing
 		fmt.Fprintln(out, "timing is now", timing)
@@ -518,173 +1094,421 @@ func optionHandler(cmd []string, out io.Writer) *Timing {
 		cl.DisableCompression()
 		fmt.Fprintln(out, "compression is now disabled")
 	case "db":
-		if cmd[2] == "" {
-			fmt.Fprintf(os.Stderr, "database argument must be set")
-			break
+		arg, err := singleArg(cmd[2], "database")
+		if err != nil {
+			return nil, err
 		}
-		db = cmd[2]
+		db = arg
 	case "user":
-		if cmd[2] == "" {
-			fmt.Fprintf(os.Stderr, "user argument must be set")
-			break
+		arg, err := singleArg(cmd[2], "user")
+		if err != nil {
+			return nil, err
 		}
-		user = cmd[2]
+		user = arg
 	case "pass":
+		arg, err := singleArg(cmd[2], "password")
+		if err != nil {
+			return nil, err
+		}
+		pass = arg
+	case "profile":
 		if cmd[2] == "" {
-			fmt.Fprintf(os.Stderr, "password argument must be set")
+			fmt.Fprintf(out, "profile is %q. available: %s\n", profile, strings.Join(profileNames(), ", "))
 			break
 		}
-		pass = cmd[2]
+		err := switchProfile(strings.TrimSpace(cmd[2]))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintln(out, "profile is now", profile)
 	default:
-		fmt.Fprintf(os.Stderr, "unrecognized option")
+		return nil, fmt.Errorf("unrecognized option %q", cmd[1])
 	}
-	return nil
+	return nil, nil
 }
 
-func createAdminHandler(cmd []string, out io.Writer) *Timing {
+func createAdminHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
 	name := strings.TrimSpace(cmd[1])
 	pass := strings.TrimSpace(cmd[2])
 	err := cl.CreateClusterAdmin(name, pass)
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-func updateAdminPassHandler(cmd []string, out io.Writer) *Timing {
+func updateAdminPassHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
 	name := strings.TrimSpace(cmd[1])
 	pass := strings.TrimSpace(cmd[2])
 	err := cl.UpdateClusterAdmin(name, pass)
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-func listAdminHandler(cmd []string, out io.Writer) *Timing {
+func listAdminHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
 	l, err := cl.GetClusterAdminList()
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
-	for k, val := range l {
-		fmt.Fprintln(out, "##", k)
-		for k, v := range val {
-			fmt.Fprintf(out, "%25s %v\n", k, v)
-		}
+	err = printList(out, mapsToSeries("admins", l))
+	if err != nil {
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-func listDbHandler(cmd []string, out io.Writer) *Timing {
+func listDbHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
 	list, err := cl.GetDatabaseList()
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
-	for _, item := range list {
-		fmt.Fprintln(out, item["name"])
+	updateDbCache(list)
+	err = printList(out, mapsToSeries("databases", list))
+	if err != nil {
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
+}
+
+// the database user commands operate on the database we're bound to
+func boundDb() (string, error) {
+	if cfg.Database == "" {
+		return "", errors.New("no database selected. use \\db <db> and bind first")
+	}
+	return cfg.Database, nil
 }
 
-func createDbHandler(cmd []string, out io.Writer) *Timing {
+func createUserHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
-	err := cl.CreateDatabase(cmd[1])
+	database, err := boundDb()
+	if err != nil {
+		return timings, err
+	}
+	name := strings.TrimSpace(cmd[1])
+	pass := strings.TrimSpace(cmd[2])
+	err = cl.CreateDatabaseUser(database, name, pass)
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-func deleteDbHandler(cmd []string, out io.Writer) *Timing {
+func updateUserPassHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
-	err := cl.DeleteDatabase(cmd[1])
+	database, err := boundDb()
+	if err != nil {
+		return timings, err
+	}
+	name := strings.TrimSpace(cmd[1])
+	pass := strings.TrimSpace(cmd[2])
+	err = cl.UpdateDatabaseUser(database, name, pass)
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-func deleteAdminHandler(cmd []string, out io.Writer) *Timing {
+func deleteUserHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
-	err := cl.DeleteClusterAdmin(strings.TrimSpace(cmd[1]))
+	database, err := boundDb()
+	if err != nil {
+		return timings, err
+	}
+	err = cl.DeleteDatabaseUser(database, strings.TrimSpace(cmd[1]))
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-func deleteServerHandler(cmd []string, out io.Writer) *Timing {
+func listUsersHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
-	id, err := strconv.ParseInt(cmd[1], 10, 32)
-	err = cl.RemoveServer(int(id))
+	database := cmd[1]
+	if database == "" {
+		var err error
+		database, err = boundDb()
+		if err != nil {
+			return timings, err
+		}
+	}
+	list, err := cl.GetDatabaseUserList(database)
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
+	}
+	err = printList(out, mapsToSeries("users", list))
+	if err != nil {
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
+}
+
+func grantAdminHandler(cmd []string, out io.Writer) (*Timing, error) {
+	return alterDbPrivilege(strings.TrimSpace(cmd[1]), true)
+}
+
+func revokeAdminHandler(cmd []string, out io.Writer) (*Timing, error) {
+	return alterDbPrivilege(strings.TrimSpace(cmd[1]), false)
 }
 
-func dropSeriesHandler(cmd []string, out io.Writer) *Timing {
+func alterDbPrivilege(name string, isAdmin bool) (*Timing, error) {
 	timings := makeTiming()
-	_, err := cl.Query(cmd[0] + ";")
+	database, err := boundDb()
+	if err != nil {
+		return timings, err
+	}
+	err = cl.AlterDatabasePrivilege(database, name, isAdmin)
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-func echoHandler(cmd []string, out io.Writer) *Timing {
+func setPermissionsHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
+	database, err := boundDb()
+	if err != nil {
+		return timings, err
+	}
+	err = cl.UpdateDatabaseUserPermissions(database, cmd[1], cmd[2], cmd[3])
 	timings.Executed = time.Now()
-	fmt.Fprintln(out, cmd[1])
+	if err != nil {
+		return timings, err
+	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-// influxdb is typed, so try to parse as int, as float, and fall back to str
-func parseTyped(value_str string) interface{} {
-	valueInt, err := strconv.ParseInt(strings.TrimSpace(value_str), 10, 64)
-	if err == nil {
-		return valueInt
+func createDbHandler(cmd []string, out io.Writer) (*Timing, error) {
+	timings := makeTiming()
+	err := cl.CreateDatabase(cmd[1])
+	timings.Executed = time.Now()
+	if err != nil {
+		return timings, err
 	}
-	valueFloat, err := strconv.ParseFloat(value_str, 64)
-	if err == nil {
+	timings.Printed = time.Now()
+	return timings, nil
+}
+
+func deleteDbHandler(cmd []string, out io.Writer) (*Timing, error) {
+	err := confirmDestructive("delete db", cmd[1])
+	if err != nil {
+		return nil, err
+	}
+	timings := makeTiming()
+	err = cl.DeleteDatabase(cmd[1])
+	timings.Executed = time.Now()
+	cachedDbs = nil
+	if err != nil {
+		return timings, err
+	}
+	timings.Printed = time.Now()
+	return timings, nil
+}
+
+func deleteAdminHandler(cmd []string, out io.Writer) (*Timing, error) {
+	name := strings.TrimSpace(cmd[1])
+	err := confirmDestructive("delete admin", name)
+	if err != nil {
+		return nil, err
+	}
+	timings := makeTiming()
+	err = cl.DeleteClusterAdmin(name)
+	timings.Executed = time.Now()
+	if err != nil {
+		return timings, err
+	}
+	timings.Printed = time.Now()
+	return timings, nil
+}
+
+func deleteServerHandler(cmd []string, out io.Writer) (*Timing, error) {
+	timings := makeTiming()
+	id, err := strconv.ParseInt(cmd[1], 10, 32)
+	if err != nil {
+		return timings, err
+	}
+	err = confirmDestructive("delete server", cmd[1])
+	if err != nil {
+		return nil, err
+	}
+	err = cl.RemoveServer(int(id))
+	timings.Executed = time.Now()
+	if err != nil {
+		return timings, err
+	}
+	timings.Printed = time.Now()
+	return timings, nil
+}
+
+func dropSeriesHandler(cmd []string, out io.Writer) (*Timing, error) {
+	name := strings.Trim(strings.TrimSpace(strings.TrimPrefix(cmd[0], "drop series")), "\"")
+	err := confirmDestructive("drop series", name)
+	if err != nil {
+		return nil, err
+	}
+	timings := makeTiming()
+	_, err = cl.Query(cmd[0] + ";")
+	timings.Executed = time.Now()
+	forgetSeries(name)
+	if err != nil {
+		return timings, err
+	}
+	timings.Printed = time.Now()
+	return timings, nil
+}
+
+func echoHandler(cmd []string, out io.Writer) (*Timing, error) {
+	timings := makeTiming()
+	timings.Executed = time.Now()
+	fmt.Fprintln(out, cmd[1])
+	timings.Printed = time.Now()
+	return timings, nil
+}
+
+// the boundary between two tuples in a values clause
+var reTupleBoundary = regexp.MustCompile("^\\)\\s*,\\s*\\(")
+
+// splitTuples splits the contents of a multi-row values clause, without the
+// outer parens, like 1,2),(3,"a),(b") into its tuples: ["1,2", "3,\"a),(b\""]
+func splitTuples(vals_str string) []string {
+	tuples := make([]string, 0, 1)
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(vals_str); i++ {
+		switch vals_str[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case ')':
+			if inQuotes {
+				continue
+			}
+			if loc := reTupleBoundary.FindStringIndex(vals_str[i:]); loc != nil {
+				tuples = append(tuples, vals_str[start:i])
+				start = i + loc[1]
+				i = start - 1
+			}
+		}
+	}
+	return append(tuples, vals_str[start:])
+}
+
+// async inserts are always sent with this precision, so that points with
+// different precisions can be committed together.
+const asyncPrecision = client.Microsecond
+
+// microseconds per unit of each precision
+var precisionFactor = map[client.TimePrecision]int64{
+	client.Second:      1000000,
+	client.Millisecond: 1000,
+	client.Microsecond: 1,
+}
+
+func finestPrecision(a, b client.TimePrecision) client.TimePrecision {
+	if precisionFactor[b] < precisionFactor[a] {
+		return b
+	}
+	return a
+}
+
+func convertTime(ts int64, from, to client.TimePrecision) int64 {
+	if from == to {
+		return ts
+	}
+	return ts * precisionFactor[from] / precisionFactor[to]
+}
+
+var reTimeNumber = regexp.MustCompile("^(-?[0-9]+)(s|ms|u)?$")
+var reTimeNow = regexp.MustCompile("^now\\(\\)(?:\\s*([+-])\\s*([0-9]+)(u|ms|s|m|h|d|w))?$")
+
+var durationUnits = map[string]time.Duration{
+	"u":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// parseTime parses the value for a time column, which can be:
+// * a number, optionally suffixed with s, ms or u. (otherwise in defaultPrecision)
+// * an RFC3339 timestamp
+// * now(), optionally followed by + or - and a duration like 1h, 30s or 7d
+// it returns the timestamp and the precision it is expressed in.
+func parseTime(value_str string, defaultPrecision client.TimePrecision) (int64, client.TimePrecision, error) {
+	value_str = strings.TrimSpace(value_str)
+	if m := reTimeNumber.FindStringSubmatch(value_str); m != nil {
+		ts, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return 0, "", err
+		}
+		if m[2] == "" {
+			return ts, defaultPrecision, nil
+		}
+		return ts, client.TimePrecision(m[2]), nil
+	}
+	var t time.Time
+	if m := reTimeNow.FindStringSubmatch(value_str); m != nil {
+		t = time.Now()
+		if m[1] != "" {
+			num, _ := strconv.ParseInt(m[2], 10, 64)
+			offset := time.Duration(num) * durationUnits[m[3]]
+			if m[1] == "-" {
+				offset = -offset
+			}
+			t = t.Add(offset)
+		}
+	} else {
+		var err error
+		t, err = time.Parse(time.RFC3339Nano, value_str)
+		if err != nil {
+			return 0, "", fmt.Errorf("Could not parse time %q: must be a number with optional s/ms/u suffix, an RFC3339 timestamp or now() [+/- duration]", value_str)
+		}
+	}
+	if t.Nanosecond()%int(time.Millisecond) != 0 {
+		return t.UnixNano() / int64(time.Microsecond), client.Microsecond, nil
+	}
+	return t.UnixNano() / int64(time.Millisecond), client.Millisecond, nil
+}
+
+// influxdb is typed, so try to parse as int, as float, and fall back to str
+func parseTyped(value_str string) interface{} {
+	valueInt, err := strconv.ParseInt(strings.TrimSpace(value_str), 10, 64)
+	if err == nil {
+		return valueInt
+	}
+	valueFloat, err := strconv.ParseFloat(value_str, 64)
+	if err == nil {
 		return valueFloat
 	}
 	return value_str
 }
 
-func bindHandler(cmd []string, out io.Writer) *Timing {
+func bindHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
 	// for some reason this call returns error (401): Invalid username/password
 	//err := cl.AuthenticateDatabaseUser(db, user, pass)
@@ -692,26 +1516,63 @@ func bindHandler(cmd []string, out io.Writer) *Timing {
 	err := getClient()
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
+}
+
+func maskPassword(pass string) string {
+	if pass == "" {
+		return ""
+	}
+	return "********"
+}
+
+// statements that contain a password
+var reCredentials = []*regexp.Regexp{
+	regexp.MustCompile("^\\\\pass\\b"),
+	regexp.MustCompile(regexCreateAdmin),
+	regexp.MustCompile(regexUpdateAdmin),
+	regexp.MustCompile(regexCreateUser),
+	regexp.MustCompile(regexUpdateUser),
+}
+
+// hasCredentials tells whether the statement contains a password, and so should stay out of the history
+func hasCredentials(stmt string) bool {
+	for _, re := range reCredentials {
+		if re.MatchString(stmt) {
+			return true
+		}
+	}
+	return false
 }
 
-func connHandler(cmd []string, out io.Writer) *Timing {
+func connHandler(cmd []string, out io.Writer) (*Timing, error) {
+	fmt.Fprintf(out, "Profile     : %s\n", profile)
 	fmt.Fprintf(out, "Host        : %s\n", cfg.Host)
 	fmt.Fprintf(out, "User        : %s\n", cfg.Username)
-	fmt.Fprintf(out, "Pass        : %s\n", cfg.Password)
+	fmt.Fprintf(out, "Pass        : %s\n", maskPassword(cfg.Password))
 	fmt.Fprintf(out, "Db          : %s\n", cfg.Database)
 	fmt.Fprintf(out, "secure      : %t\n", cfg.IsSecure)
-	fmt.Fprintf(out, "udp         : %t\n", cfg.IsUDP)
+	if udp {
+		fmt.Fprintf(out, "udp         : inserts go to %s:%d over udp. times are sent in ms,\n", host, udpPort)
+		fmt.Fprintf(out, "              the db is the one configured for the server's udp listener,\n")
+		fmt.Fprintf(out, "              and errors are not reported (fire and forget)\n")
+	} else {
+		fmt.Fprintf(out, "udp         : %t\n", udp)
+	}
 	fmt.Fprintf(out, "compression : ?\n") // can't query client for this
-	fmt.Fprintf(out, "Client      : %s\n", cfg.HttpClient)
-	return nil
+	fmt.Fprintf(out, "Client      : %v\n", cfg.HttpClient)
+	if cfg.IsSecure {
+		fmt.Fprintf(out, "ca cert     : %s\n", caCert)
+		fmt.Fprintf(out, "client cert : %s\n", clientCert)
+		fmt.Fprintf(out, "skip verify : %t\n", insecureSkipVerify)
+	}
+	return nil, nil
 }
 
-func insertHandler(cmd []string, out io.Writer) *Timing {
+func insertHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
 	series_name := cmd[1]
 	cols_str := strings.TrimPrefix(cmd[2], " ")
@@ -726,60 +1587,331 @@ func insertHandler(cmd []string, out io.Writer) *Timing {
 	} else {
 		cols = []string{"time", "sequence_number", "value"}
 	}
-	vals_str := cmd[3]
-	// vals_str could be: foo,bar,"avg(something,123)",quux
-	reader := csv.NewReader(strings.NewReader(vals_str))
-	values, err := reader.Read()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not parse values"+err.Error()+"\n")
-		return timings
+	// cmd[3] could be: foo,bar,"avg(something,123)",quux),(foo2,bar2,"baz",quux2
+	tuples := splitTuples(cmd[3])
+	points := make([][]interface{}, 0, len(tuples))
+	timeCol := -1
+	for i, col := range cols {
+		if col == "time" {
+			timeCol = i
+		}
 	}
-
-	if len(values) != len(cols) {
-		fmt.Fprintf(os.Stderr, "Number of values (%d) must match number of colums (%d): Columns are: %v\n", len(values), len(cols), cols)
-		return timings
+	// the precision we send with. if the points use different precisions,
+	// we pick the finest one and convert the others.
+	precision := client.Second
+	if timeCol == -1 {
+		precision = client.Millisecond
+	}
+	precisions := make([]client.TimePrecision, 0, len(tuples))
+	valid := true
+	for i, vals_str := range tuples {
+		reader := csv.NewReader(strings.NewReader(vals_str))
+		values, err := reader.Read()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tuple %d: Could not parse values: %s\n", i+1, err.Error())
+			valid = false
+			continue
+		}
+		if len(values) != len(cols) {
+			fmt.Fprintf(os.Stderr, "tuple %d: Number of values (%d) must match number of colums (%d): Columns are: %v\n", i+1, len(values), len(cols), cols)
+			valid = false
+			continue
+		}
+		point := make([]interface{}, len(cols), len(cols))
+		for j, value_str := range values {
+			point[j] = parseTyped(value_str)
+		}
+		if timeCol != -1 {
+			ts, prec, err := parseTime(values[timeCol], client.Millisecond)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "tuple %d: %s\n", i+1, err.Error())
+				valid = false
+				continue
+			}
+			point[timeCol] = ts
+			precisions = append(precisions, prec)
+			precision = finestPrecision(precision, prec)
+		}
+		points = append(points, point)
 	}
-	point := make([]interface{}, len(cols), len(cols))
-
-	for i, value_str := range values {
-		point[i] = parseTyped(value_str)
+	if !valid {
+		return timings, errors.New("nothing inserted")
 	}
 
 	serie := &client.Series{
 		Name:    series_name,
 		Columns: cols,
-		Points:  [][]interface{}{point},
+		Points:  points,
+	}
+
+	var err error
+
+	if async {
+		precision = asyncPrecision
+	}
+	if timeCol != -1 {
+		for i, point := range points {
+			point[timeCol] = convertTime(point[timeCol].(int64), precisions[i], precision)
+		}
 	}
 
 	if async {
-		asyncInserts <- serie
-		err = nil
+		err = queueAsync(serie)
 	} else {
 		ts := time.Now()
-		err = cl.WriteSeries([]*client.Series{serie})
+		err = writeSeries([]*client.Series{serie}, precision)
 		sync_inserts_timer.Update(time.Since(ts))
 	}
 	timings.Executed = time.Now()
+	forgetSeries(series_name)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
+func importCsvHandler(cmd []string, out io.Writer) (*Timing, error) {
+	timings := makeTiming()
+	file := strings.Trim(cmd[1], "\"")
+	series_name := strings.Trim(cmd[2], "\"")
+	timeCol := cmd[4]
+	precision := client.Millisecond
+	if cmd[5] != "" {
+		precision = client.TimePrecision(cmd[5])
+	}
+	writePrecision := precision
+	if async {
+		writePrecision = asyncPrecision
+	}
+
+	fd, err := os.Open(file)
+	if err != nil {
+		return timings, err
+	}
+	defer fd.Close()
+	reader := csv.NewReader(bufio.NewReader(fd))
+	reader.FieldsPerRecord = -1 // we report wrong field counts ourselves
+
+	line := 0
+	var cols []string
+	if cmd[3] != "" {
+		for _, name := range strings.Split(cmd[3], ",") {
+			cols = append(cols, strings.TrimSpace(name))
+		}
+	} else {
+		cols, err = reader.Read()
+		line++
+		if err != nil {
+			return timings, fmt.Errorf("Could not read header from %s: %s", file, err.Error())
+		}
+		for i, name := range cols {
+			cols[i] = strings.TrimSpace(name)
+		}
+	}
+	timeIdx := -1
+	if timeCol != "" {
+		for i, name := range cols {
+			if name == timeCol {
+				cols[i] = "time"
+				timeIdx = i
+			}
+		}
+		if timeIdx == -1 {
+			return timings, fmt.Errorf("time column %q not found. Columns are: %v", timeCol, cols)
+		}
+	} else {
+		// like insert, a column named time is the time, and needs converting to the write precision
+		for i, name := range cols {
+			if name == "time" {
+				timeIdx = i
+			}
+		}
+	}
+
+	imported := 0
+	failed := 0
+	batch := make([][]interface{}, 0, AsyncCapacity)
+	t := metrics.GetOrRegisterTimer("import_csv", metrics.DefaultRegistry)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		serie := &client.Series{Name: series_name, Columns: cols, Points: batch}
+		ts := time.Now()
+		err := writeSeries([]*client.Series{serie}, writePrecision)
+		t.Update(time.Since(ts))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "line %d: failed to write batch of %d rows: %s\n", line, len(batch), err.Error())
+			failed += len(batch)
+		} else {
+			imported += len(batch)
+		}
+		batch = make([][]interface{}, 0, AsyncCapacity)
+	}
+
+	for {
+		values, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "line %d: %s\n", line, err.Error())
+			failed++
+			continue
+		}
+		if len(values) != len(cols) {
+			fmt.Fprintf(os.Stderr, "line %d: number of values (%d) must match number of colums (%d)\n", line, len(values), len(cols))
+			failed++
+			continue
+		}
+		point := make([]interface{}, len(cols))
+		for i, value_str := range values {
+			point[i] = parseTyped(value_str)
+		}
+		if timeIdx != -1 {
+			ts, prec, err := parseTime(values[timeIdx], precision)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "line %d: %s\n", line, err.Error())
+				failed++
+				continue
+			}
+			point[timeIdx] = convertTime(ts, prec, writePrecision)
+		}
+		if async {
+			err := queueAsync(&client.Series{
+				Name:    series_name,
+				Columns: cols,
+				Points:  [][]interface{}{point},
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "line %d: %s\n", line, err.Error())
+				failed++
+				continue
+			}
+			imported++
+			continue
+		}
+		batch = append(batch, point)
+		if len(batch) == AsyncCapacity {
+			flush()
+		}
+	}
+	flush()
+	timings.Executed = time.Now()
+	forgetSeries(series_name)
+
+	duration := timings.Executed.Sub(timings.Pre)
+	rate := float64(imported) / duration.Seconds()
+	verb := "imported"
+	if async {
+		verb = "queued"
+	}
+	fmt.Fprintf(out, "%s %d rows from %s in %s (%.0f rows/sec), %d errors\n", verb, imported, file, duration, rate, failed)
+	timings.Printed = time.Now()
+	if failed > 0 {
+		return timings, fmt.Errorf("%d rows could not be imported", failed)
+	}
+	return timings, nil
+}
+
+// coalesceSeries merges the points of series that share a name and column set,
+// so a batch of inserts into the same series is sent as one series.
+// series are kept in order of first appearance.
+func coalesceSeries(series []*client.Series) []*client.Series {
+	merged := make([]*client.Series, 0, len(series))
+	index := make(map[string]int)
+	for _, serie := range series {
+		key := serie.Name + "\x00" + strings.Join(serie.Columns, "\x00")
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(merged)
+			points := make([][]interface{}, len(serie.Points))
+			copy(points, serie.Points)
+			merged = append(merged, &client.Series{Name: serie.Name, Columns: serie.Columns, Points: points})
+			continue
+		}
+		merged[i].Points = append(merged[i].Points, serie.Points...)
+	}
+	return merged
+}
+
+// payloadSize estimates the size in bytes of the json body sent for the series.
+// marshaling the batch just to measure it would be too expensive for the commit path,
+// so we count the exact per-series overhead (which is what coalescing saves),
+// and assume valueSize bytes per value.
+func payloadSize(series []*client.Series) int64 {
+	const seriesOverhead = len(`{"name":"","columns":[],"points":[]},`)
+	const valueSize = 8
+	size := 2 // the surrounding []
+	for _, serie := range series {
+		size += seriesOverhead + len(serie.Name)
+		for _, col := range serie.Columns {
+			size += len(col) + 3 // quotes and comma
+		}
+		for _, p := range serie.Points {
+			size += 3 + len(p)*(valueSize+1) // brackets, comma and value separators
+		}
+	}
+	return int64(size)
+}
+
+// queueAsync hands the serie to the committer. with a spool, it only returns once the
+// serie is on disk, so we never acknowledge an insert that a crash could lose.
+func queueAsync(serie *client.Series) error {
+	asyncInserts <- serie
+	if spool != nil {
+		if err := <-asyncSpooled; err != nil {
+			return fmt.Errorf("could not append insert to spool: %s", err.Error())
+		}
+	}
+	return nil
+}
+
 func committer() {
 	toCommit := make([]*client.Series, 0, AsyncCapacity)
+	// inserts we could neither write nor dead-letter. they're still in the spool, so it can't be truncated
+	// until they're persisted too. we retry them with the next commit.
+	var failed []*client.Series
+	payloadBefore := metrics.GetOrRegisterHistogram("inserts_async_payload_before", metrics.DefaultRegistry, metrics.NewUniformSample(1028))
+	payloadAfter := metrics.GetOrRegisterHistogram("inserts_async_payload_after", metrics.DefaultRegistry, metrics.NewUniformSample(1028))
 
 	commit := func() int {
 		size := len(toCommit)
-		if size == 0 {
+		if size == 0 && len(failed) == 0 {
 			return 0
 		}
 		t := metrics.GetOrRegisterTimer("inserts_async_"+strconv.FormatInt(int64(len(toCommit)), 10), metrics.DefaultRegistry)
 		defer func(start time.Time) { t.Update(time.Since(start)) }(time.Now())
-		err := cl.WriteSeries(toCommit)
+		pending := append(failed, toCommit...)
+		series := coalesceSeries(pending)
+		payloadBefore.Update(payloadSize(pending))
+		payloadAfter.Update(payloadSize(series))
+		// the inserts can be removed from the spool once they're written or dead-lettered
+		persisted := true
+		err := writeWithRetry(series, asyncPrecision)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to write %d series: %s\n", len(toCommit), err.Error())
+			atomic.AddInt64(&asyncWriteFailures, 1)
+			fmt.Fprintf(os.Stderr, "Failed to write %d series after %d retries: %s\n", len(series), AsyncRetries, err.Error())
+			err = writeDeadLetter(series, asyncPrecision)
+			if err != nil {
+				persisted = false
+				fmt.Fprintf(os.Stderr, "Could not write them to dead letter file %s: %s\n", path_deadletter, err.Error())
+			} else {
+				fmt.Fprintf(os.Stderr, "Wrote them to %s. use 'replay deadletter' to resend them\n", path_deadletter)
+			}
+		}
+		if persisted {
+			failed = nil
+			if spool != nil {
+				err = spool.Truncate()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Could not truncate spool: %s\n", err.Error())
+				}
+			}
+		} else {
+			failed = pending
+			fmt.Fprintf(os.Stderr, "Keeping %d inserts to retry with the next batch\n", len(failed))
 		}
 		toCommit = make([]*client.Series, 0, AsyncCapacity)
 		return size
@@ -792,6 +1924,14 @@ CommitLoop:
 		select {
 		case serie, ok := <-asyncInserts:
 			if ok {
+				if spool != nil {
+					err := spool.Append(serie)
+					asyncSpooled <- err
+					if err != nil {
+						// the insert is reported as failed, so don't write it
+						continue
+					}
+				}
 				toCommit = append(toCommit, serie)
 			} else {
 				// no more input, commit whatever we have and break
@@ -813,45 +1953,55 @@ CommitLoop:
 	}
 }
 
-func pingHandler(cmd []string, out io.Writer) *Timing {
+func pingHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
 	err := cl.Ping()
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-func listServersHandler(cmd []string, out io.Writer) *Timing {
+func listServersHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
 	list, err := cl.Servers()
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
-	for _, server := range list {
-		fmt.Fprintln(out, "## id", server["id"])
-		for k, v := range server {
-			if k != "id" {
-				fmt.Fprintf(out, "%25s %v\n", k, v)
-			}
-		}
+	err = printList(out, mapsToSeries("servers", list))
+	if err != nil {
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-func listSeriesHandler(cmd []string, out io.Writer) *Timing {
+func listSeriesHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
 	list_series, err := cl.Query(cmd[0])
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
+	}
+	if cmd[0] == "list series" {
+		updateSeriesCache(list_series)
+	}
+	if format != "table" {
+		names := &client.Series{Name: "series", Columns: []string{"name"}, Points: make([][]interface{}, 0)}
+		for _, series := range list_series {
+			for _, p := range series.Points {
+				names.Points = append(names.Points, []interface{}{p[1]})
+			}
+		}
+		err = printList(out, names)
+		if err != nil {
+			return timings, err
+		}
+		timings.Printed = time.Now()
+		return timings, nil
 	}
 	for _, series := range list_series {
 		for _, p := range series.Points {
@@ -859,144 +2009,479 @@ func listSeriesHandler(cmd []string, out io.Writer) *Timing {
 		}
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-func listShardspacesHandler(cmd []string, out io.Writer) *Timing {
+func listShardspacesHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
 	shardSpaces, err := cl.GetShardSpaces()
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
+	}
+	spaces := &client.Series{
+		Name:    "shardspaces",
+		Columns: []string{"Database", "Name", "Regex", "Retention", "Duration", "RF", "Split"},
+		Points:  make([][]interface{}, len(shardSpaces)),
+	}
+	for i, s := range shardSpaces {
+		spaces.Points[i] = []interface{}{s.Database, s.Name, s.Regex, s.RetentionPolicy, s.ShardDuration, s.ReplicationFactor, s.Split}
+	}
+	err = printList(out, spaces)
+	if err != nil {
+		return timings, err
 	}
-	dbLenMax := len("Database")
-	nameLenMax := len("Name")
-	regexLenMax := len("Regex")
-	retentionLenMax := len("Retention")
-	durationLenMax := len("Duration")
+	timings.Printed = time.Now()
+	return timings, nil
+}
 
-	for _, s := range shardSpaces {
-		if len(s.Database) > dbLenMax {
-			dbLenMax = len(s.Database)
+var formats = []string{"table", "csv", "json", "ndjson"}
+
+func validFormat(f string) bool {
+	for _, valid := range formats {
+		if f == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// influxdb returns timestamps as float64 ms since epoch
+func msToTime(msFloat float64) time.Time {
+	ns := (int64(msFloat) % 1000) * 1000000
+	s := int64(msFloat / 1000)
+	return time.Unix(s, ns)
+}
+
+// valueString formats a value the way you'd want to see it in a spreadsheet:
+// json numbers come in as float64, so print them without exponent.
+func valueString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// writeCsv writes an RFC 4180 csv document (so with CRLF line endings), with header unless records-only is enabled
+func writeCsv(out io.Writer, header []string, rows [][]string) error {
+	w := csv.NewWriter(out)
+	w.UseCRLF = true
+	if !recordsOnly {
+		w.Write(header)
+	}
+	w.WriteAll(rows)
+	return w.Error()
+}
+
+// printSeries renders query results in the configured output format.
+// csv and ndjson have a row per point, so they get the series name in a name column.
+func printSeries(out io.Writer, series []*client.Series) error {
+	return renderSeries(out, series, true)
+}
+
+// printList renders the output of a list command. the series name is just a label for the list,
+// so it's left out of the rows, and the list can have a name column of its own.
+func printList(out io.Writer, serie *client.Series) error {
+	return renderSeries(out, []*client.Series{serie}, false)
+}
+
+func renderSeries(out io.Writer, series []*client.Series, withName bool) error {
+	switch format {
+	case "table":
+		for _, serie := range series {
+			var err error
+			if expanded {
+				err = printVertical(out, serie)
+			} else {
+				err = printTable(out, serie)
+			}
+			if err != nil {
+				return err
+			}
 		}
-		if len(s.Name) > nameLenMax {
-			nameLenMax = len(s.Name)
+	case "csv":
+		header, rows := seriesRows(series, withName)
+		return writeCsv(out, header, rows)
+	case "json":
+		return writeJson(out, series)
+	case "ndjson":
+		return writeNdjson(out, series, withName)
+	default:
+		return fmt.Errorf("format %q can't be used to print series", format)
+	}
+	return nil
+}
+
+// seriesRows flattens all series into one set of rows, so they can be written as one csv document.
+// the header is the union of all columns in order of appearance, preceded by the series name if withName.
+func seriesRows(series []*client.Series, withName bool) ([]string, [][]string) {
+	header := make([]string, 0)
+	if withName {
+		header = append(header, "name")
+	}
+	index := make(map[string]int)
+	for _, serie := range series {
+		for _, col := range serie.Columns {
+			if _, ok := index[col]; !ok {
+				index[col] = len(header)
+				header = append(header, col)
+			}
+		}
+	}
+	rows := make([][]string, 0)
+	for _, serie := range series {
+		for _, p := range serie.Points {
+			row := make([]string, len(header))
+			if withName {
+				row[0] = serie.Name
+			}
+			for i, v := range p {
+				if i < len(serie.Columns) {
+					row[index[serie.Columns[i]]] = valueString(v)
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	return header, rows
+}
+
+// writeJson writes all series as one json array of {name, columns, points} objects
+func writeJson(out io.Writer, series []*client.Series) error {
+	if series == nil {
+		series = []*client.Series{}
+	}
+	data, err := json.Marshal(series)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}
+
+// writeNdjson writes one json object per point, with the column names as keys,
+// preceded by the series name if withName. (a name column of the series itself takes precedence,
+// so we don't write duplicate keys.)
+// we build the objects by hand to preserve the column order.
+func writeNdjson(out io.Writer, series []*client.Series, withName bool) error {
+	for _, serie := range series {
+		addName := withName
+		for _, col := range serie.Columns {
+			if col == "name" {
+				addName = false
+			}
+		}
+		for _, p := range serie.Points {
+			var buf bytes.Buffer
+			buf.WriteByte('{')
+			if addName {
+				name, err := json.Marshal(serie.Name)
+				if err != nil {
+					return err
+				}
+				buf.WriteString(`"name":`)
+				buf.Write(name)
+			}
+			for i, col := range serie.Columns {
+				if i > 0 || addName {
+					buf.WriteByte(',')
+				}
+				key, err := json.Marshal(col)
+				if err != nil {
+					return err
+				}
+				var val []byte
+				if i < len(p) {
+					val, err = json.Marshal(p[i])
+				} else {
+					val, err = json.Marshal(nil)
+				}
+				if err != nil {
+					return err
+				}
+				buf.Write(key)
+				buf.WriteByte(':')
+				buf.Write(val)
+			}
+			buf.WriteString("}\n")
+			_, err := out.Write(buf.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mapsToSeries turns the list of objects returned by the various list calls
+// into a series, with the union of all keys (sorted) as columns
+func mapsToSeries(name string, list []map[string]interface{}) *client.Series {
+	keys := make(map[string]bool)
+	for _, item := range list {
+		for k := range item {
+			keys[k] = true
+		}
+	}
+	cols := make([]string, 0, len(keys))
+	for k := range keys {
+		cols = append(cols, k)
+	}
+	sort.Strings(cols)
+	serie := &client.Series{Name: name, Columns: cols, Points: make([][]interface{}, len(list))}
+	for i, item := range list {
+		serie.Points[i] = make([]interface{}, len(cols))
+		for j, col := range cols {
+			serie.Points[i][j] = item[col]
 		}
-		if len(s.Regex) > regexLenMax {
-			regexLenMax = len(s.Regex)
+	}
+	return serie
+}
+
+var reShardSpaceOption = regexp.MustCompile("^(?:regex '([^']*)'|(retention|duration|replication|split) ([^ ]+))(?: +|$)")
+
+// parseShardSpaceOptions applies options like "regex '/^foo/' retention 30d split 2" to space
+func parseShardSpaceOptions(opts string, space *client.ShardSpace) error {
+	opts = strings.TrimSpace(opts)
+	for opts != "" {
+		m := reShardSpaceOption.FindStringSubmatch(opts)
+		if m == nil {
+			return fmt.Errorf("Could not parse shardspace options at %q", opts)
 		}
-		if len(s.RetentionPolicy) > retentionLenMax {
-			retentionLenMax = len(s.RetentionPolicy)
+		opts = opts[len(m[0]):]
+		if m[2] == "" {
+			space.Regex = m[1]
+			continue
 		}
-		if len(s.ShardDuration) > durationLenMax {
-			durationLenMax = len(s.ShardDuration)
+		switch m[2] {
+		case "retention":
+			space.RetentionPolicy = m[3]
+		case "duration":
+			space.ShardDuration = m[3]
+		case "replication", "split":
+			num, err := strconv.ParseUint(m[3], 10, 32)
+			if err != nil {
+				return fmt.Errorf("%s must be a number: %s", m[2], err.Error())
+			}
+			if m[2] == "replication" {
+				space.ReplicationFactor = uint32(num)
+			} else {
+				space.Split = uint32(num)
+			}
 		}
 	}
-	headerFmt := fmt.Sprintf("%%%ds %%%ds %%%ds %%%ds %%%ds %%2s %%5s\n", dbLenMax, nameLenMax, regexLenMax, retentionLenMax, durationLenMax)
-	rowFmt := fmt.Sprintf("%%%ds %%%ds %%%ds %%%ds %%%ds %%2d %%5d\n", dbLenMax, nameLenMax, regexLenMax, retentionLenMax, durationLenMax)
-	fmt.Fprintf(out, headerFmt, "Database", "Name", "Regex", "Retention", "Duration", "RF", "Split")
+	return nil
+}
+
+func createShardSpaceHandler(cmd []string, out io.Writer) (*Timing, error) {
+	timings := makeTiming()
+	space := &client.ShardSpace{Name: cmd[2], Database: cmd[1]}
+	err := parseShardSpaceOptions(cmd[3], space)
+	if err != nil {
+		return timings, err
+	}
+	if space.Regex == "" {
+		return timings, errors.New("a regex must be specified")
+	}
+	err = cl.CreateShardSpace(cmd[1], space)
+	timings.Executed = time.Now()
+	if err != nil {
+		return timings, err
+	}
+	timings.Printed = time.Now()
+	return timings, nil
+}
+
+func updateShardSpaceHandler(cmd []string, out io.Writer) (*Timing, error) {
+	timings := makeTiming()
+	shardSpaces, err := cl.GetShardSpaces()
+	if err != nil {
+		return timings, err
+	}
+	var space *client.ShardSpace
 	for _, s := range shardSpaces {
-		fmt.Fprintf(out, rowFmt, s.Database, s.Name, s.Regex, s.RetentionPolicy, s.ShardDuration, s.ReplicationFactor, s.Split)
+		if s.Database == cmd[1] && s.Name == cmd[2] {
+			space = s
+		}
+	}
+	if space == nil {
+		return timings, fmt.Errorf("shardspace %s not found in database %s", cmd[2], cmd[1])
+	}
+	err = parseShardSpaceOptions(cmd[3], space)
+	if err != nil {
+		return timings, err
+	}
+	err = cl.UpdateShardSpace(cmd[1], cmd[2], space)
+	timings.Executed = time.Now()
+	if err != nil {
+		return timings, err
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-func selectHandler(cmd []string, out io.Writer) *Timing {
+func dropShardSpaceHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
-	series, err := cl.Query(cmd[0] + ";")
+	err := cl.DropShardSpace(cmd[1], cmd[2])
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
-	type Spec struct {
-		Header string
-		Row    string
+	timings.Printed = time.Now()
+	return timings, nil
+}
+
+func listShardsHandler(cmd []string, out io.Writer) (*Timing, error) {
+	timings := makeTiming()
+	shards, err := cl.GetShards()
+	timings.Executed = time.Now()
+	if err != nil {
+		return timings, err
 	}
-	specs := map[string]Spec{
-		"time":            {"%20s", "%20f"},
-		"sequence_number": {"%16s", "      %10f"},
-		"value":           {"%20s", "%20f"},
+	serie := &client.Series{
+		Name:    "shards",
+		Columns: []string{"Id", "Database", "Space", "Start", "End", "Servers"},
+		Points:  make([][]interface{}, len(shards.All)),
+	}
+	for i, s := range shards.All {
+		// shard start and end times are in seconds
+		var start, end interface{} = s.StartTime, s.EndTime
+		if dateTime {
+			start = time.Unix(s.StartTime, 0).String()
+			end = time.Unix(s.EndTime, 0).String()
+		}
+		servers := make([]string, len(s.ServerIds))
+		for j, id := range s.ServerIds {
+			servers[j] = strconv.FormatUint(uint64(id), 10)
+		}
+		serie.Points[i] = []interface{}{s.Id, s.Database, s.SpaceName, start, end, strings.Join(servers, ",")}
 	}
-	if dateTime {
-		specs["time"] = Spec{"%33s", "%33s"}
+	err = printList(out, serie)
+	if err != nil {
+		return timings, err
 	}
-	defaultSpec := Spec{"%20s", "%20v"}
-	var spec Spec
-	var ok bool
+	timings.Printed = time.Now()
+	return timings, nil
+}
 
-	for _, serie := range series {
-		if !recordsOnly {
-			fmt.Fprintln(out, "##", serie.Name)
+func dropShardHandler(cmd []string, out io.Writer) (*Timing, error) {
+	timings := makeTiming()
+	id, err := strconv.ParseUint(cmd[1], 10, 32)
+	if err != nil {
+		return timings, err
+	}
+	serverIds := make([]uint32, 0)
+	for _, s := range strings.Fields(cmd[2]) {
+		serverId, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return timings, err
+		}
+		serverIds = append(serverIds, uint32(serverId))
+	}
+	if len(serverIds) == 0 {
+		// drop it from all servers it lives on
+		shards, err := cl.GetShards()
+		if err != nil {
+			return timings, err
+		}
+		for _, s := range shards.All {
+			if s.Id == uint32(id) {
+				serverIds = s.ServerIds
+			}
+		}
+		if len(serverIds) == 0 {
+			return timings, fmt.Errorf("shard %d not found", id)
 		}
+	}
+	err = cl.DropShard(uint32(id), serverIds)
+	timings.Executed = time.Now()
+	if err != nil {
+		return timings, err
+	}
+	timings.Printed = time.Now()
+	return timings, nil
+}
 
-		colrows := make([]string, len(serie.Columns), len(serie.Columns))
+// select ... from <series> into <target> creates a continuous query.
+// we look for it after removing strings and regexes, so e.g. where msg = 'into' doesn't count.
+var reQuoted = regexp.MustCompile("'(?:[^'\\\\]|\\\\.)*'|\"(?:[^\"\\\\]|\\\\.)*\"|/(?:[^/\\\\]|\\\\.)*/")
+var reSelectInto = regexp.MustCompile("(?i)\\bfrom\\s+\\S+.*\\binto\\s+\\S+")
 
-		for i, col := range serie.Columns {
-			if spec, ok = specs[col]; !ok {
-				spec = defaultSpec
-			}
-			if !recordsOnly {
-				fmt.Fprintf(out, spec.Header, col)
+func isSelectInto(stmt string) bool {
+	return reSelectInto.MatchString(reQuoted.ReplaceAllString(stmt, "''"))
+}
+
+func selectHandler(cmd []string, out io.Writer) (*Timing, error) {
+	if readOnly && isSelectInto(cmd[0]) {
+		return nil, errors.New("refusing to create a continuous query (select ... into) in read-only mode. use \\readonly to toggle")
+	}
+	timings := makeTiming()
+	series, err := cl.Query(cmd[0] + ";")
+	timings.Executed = time.Now()
+	if err != nil {
+		return timings, err
+	}
+	countQuery(series)
+	if dateTime {
+		for _, serie := range series {
+			for _, p := range serie.Points {
+				p[0] = msToTime(p[0].(float64)).String()
 			}
-			colrows[i] = spec.Row
 		}
+	}
+	if format != "table" || expanded {
+		err = printSeries(out, series)
+		if err != nil {
+			return timings, err
+		}
+		timings.Printed = time.Now()
+		return timings, nil
+	}
+	for _, serie := range series {
 		if !recordsOnly {
-			fmt.Fprintln(out)
+			fmt.Fprintln(out, "##", serie.Name)
 		}
-		for _, p := range serie.Points {
-			for i, fmtStr := range colrows {
-				if i == 0 && dateTime {
-					msFloat := p[i].(float64)
-					ns := (int64(msFloat) % 1000) * 1000000
-					s := int64(msFloat / 1000)
-					d := time.Unix(s, ns)
-					fmt.Fprintf(out, fmtStr, d)
-				} else {
-					fmt.Fprintf(out, fmtStr, p[i])
-				}
-			}
-			fmt.Fprintln(out)
+		err = printTable(out, serie)
+		if err != nil {
+			return timings, err
 		}
 	}
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-func rawHandler(cmd []string, out io.Writer) *Timing {
+func rawHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
 	result, err := cl.Query(cmd[1] + ";")
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
 	}
+	countQuery(result)
 	spew.Dump(result)
 	timings.Printed = time.Now()
-	return timings
+	return timings, nil
 }
 
-func writeRcHandler(cmd []string, out io.Writer) *Timing {
+func writeRcHandler(cmd []string, out io.Writer) (*Timing, error) {
 	timings := makeTiming()
-	tpl := `host = "%s"
-port = %d
-user = "%s"
-pass = "%s"
-db = "%s"
-`
-	rc, err := os.Create(path_rc)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+	name := cmd[1]
+	if name == "" {
+		name = profile
 	}
-	_, err = fmt.Fprintf(rc, tpl, host, port, user, pass, db)
-
+	err := saveRc(name, out)
 	timings.Executed = time.Now()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		return timings
+		return timings, err
+	}
+	if name != "" {
+		fmt.Fprintf(out, "saved current parameters as profile %s in %s\n", name, path_rc)
+	} else {
+		fmt.Fprintf(out, "saved current parameters in %s\n", path_rc)
 	}
-	return timings
+	return timings, nil
 }
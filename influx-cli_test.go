@@ -1,10 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/BurntSushi/toml"
 	"github.com/davecgh/go-spew/spew"
+	"github.com/influxdb/influxdb/client"
+	"github.com/rcrowley/go-metrics"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func regexTest(regex *regexp.Regexp, test string, expected []string, t *testing.T) {
@@ -27,6 +48,10 @@ func Test_ParseOption(t *testing.T) {
 		"\\db foo1",
 		[]string{"\\db foo1", "db", "foo1"},
 		t)
+	regexTest(re,
+		"\\i scripts/setup.txt",
+		[]string{"\\i scripts/setup.txt", "i", "scripts/setup.txt"},
+		t)
 }
 
 func Test_ParseInsert(t *testing.T) {
@@ -40,3 +65,1724 @@ func Test_ParseInsert(t *testing.T) {
 		[]string{"insert into demo values (1406231160000, 0, 10)", "demo", "", "1406231160000, 0, 10"},
 		t)
 }
+
+func Test_WriteCsv(t *testing.T) {
+	var buf bytes.Buffer
+	rows := [][]string{
+		{"1406231160000", "plain"},
+		{"1406231170000", "with, comma"},
+		{"1406231180000", "with \"quotes\""},
+	}
+	err := writeCsv(&buf, []string{"time", "value"}, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "time,value\r\n1406231160000,plain\r\n1406231170000,\"with, comma\"\r\n1406231180000,\"with \"\"quotes\"\"\"\r\n"
+	if buf.String() != expected {
+		t.Errorf("expected: %q\ngot     : %q\n", expected, buf.String())
+	}
+}
+
+func Test_ValueString(t *testing.T) {
+	cases := map[string]interface{}{
+		"1406231160000": float64(1406231160000),
+		"0.5":           0.5,
+		"foo":           "foo",
+		"":              nil,
+		"true":          true,
+	}
+	for expected, in := range cases {
+		if got := valueString(in); got != expected {
+			t.Errorf("valueString(%v): expected %q, got %q", in, expected, got)
+		}
+	}
+}
+
+func Test_WriteJson(t *testing.T) {
+	series := []*client.Series{
+		{Name: "foo", Columns: []string{"time", "value"}, Points: [][]interface{}{{float64(1406231160000), "a"}, {float64(1406231170000), 2.5}}},
+	}
+	var buf bytes.Buffer
+	err := writeJson(&buf, series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"name":"foo","columns":["time","value"],"points":[[1406231160000,"a"],[1406231170000,2.5]]}]` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected: %q\ngot     : %q\n", expected, buf.String())
+	}
+
+	buf.Reset()
+	err = writeNdjson(&buf, series, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `{"name":"foo","time":1406231160000,"value":"a"}` + "\n" + `{"name":"foo","time":1406231170000,"value":2.5}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected: %q\ngot     : %q\n", expected, buf.String())
+	}
+
+	// list commands have their own name column
+	buf.Reset()
+	err = writeNdjson(&buf, []*client.Series{mapsToSeries("admins", []map[string]interface{}{{"name": "root"}})}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `{"name":"root"}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected: %q\ngot     : %q\n", expected, buf.String())
+	}
+
+	// a list without a name column doesn't get the series name either
+	buf.Reset()
+	err = writeNdjson(&buf, []*client.Series{{Name: "servers", Columns: []string{"id"}, Points: [][]interface{}{{float64(1)}}}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `{"id":1}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected: %q\ngot     : %q\n", expected, buf.String())
+	}
+}
+
+func Test_CsvMultipleSeries(t *testing.T) {
+	defer func(f string, r bool) { format, recordsOnly = f, r }(format, recordsOnly)
+	format, recordsOnly = "csv", false
+	series := []*client.Series{
+		{Name: "foo", Columns: []string{"time", "value"}, Points: [][]interface{}{{float64(1), "a"}, {float64(2), "b"}}},
+		{Name: "bar", Columns: []string{"time", "other"}, Points: [][]interface{}{{float64(3), 4.5}}},
+	}
+	var buf bytes.Buffer
+	err := printSeries(&buf, series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "name,time,value,other\r\nfoo,1,a,\r\nfoo,2,b,\r\nbar,3,,4.5\r\n"
+	if buf.String() != expected {
+		t.Errorf("expected: %q\ngot     : %q\n", expected, buf.String())
+	}
+
+	// a name field in the data doesn't make it list output
+	series = []*client.Series{
+		{Name: "foo", Columns: []string{"time", "name"}, Points: [][]interface{}{{float64(1), "a"}}},
+		{Name: "bar", Columns: []string{"time", "value"}, Points: [][]interface{}{{float64(2), "b"}}},
+	}
+	buf.Reset()
+	if err := printSeries(&buf, series); err != nil {
+		t.Fatal(err)
+	}
+	expected = "name,time,name,value\r\nfoo,1,a,\r\nbar,2,,b\r\n"
+	if buf.String() != expected {
+		t.Errorf("expected: %q\ngot     : %q\n", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := printList(&buf, &client.Series{Name: "series", Columns: []string{"name"}, Points: [][]interface{}{{"foo"}}}); err != nil {
+		t.Fatal(err)
+	}
+	expected = "name\r\nfoo\r\n"
+	if buf.String() != expected {
+		t.Errorf("expected: %q\ngot     : %q\n", expected, buf.String())
+	}
+}
+
+func Test_MapsToSeries(t *testing.T) {
+	list := []map[string]interface{}{
+		{"name": "root"},
+		{"name": "dieter", "isAdmin": true},
+	}
+	serie := mapsToSeries("admins", list)
+	expected := &client.Series{
+		Name:    "admins",
+		Columns: []string{"isAdmin", "name"},
+		Points:  [][]interface{}{{nil, "root"}, {true, "dieter"}},
+	}
+	if !reflect.DeepEqual(serie, expected) {
+		t.Errorf("expected: %v\ngot     : %v\n", spew.Sdump(expected), spew.Sdump(serie))
+	}
+}
+
+func Test_Table(t *testing.T) {
+	table := NewTable([]string{"name", "value"})
+	table.AddRow([]string{"a", "1"})
+	table.AddRow([]string{"日本", "100"})
+
+	var buf bytes.Buffer
+	err := table.Render(&buf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "name  value\n" +
+		"a         1\n" +
+		"日本    100\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s\n", expected, buf.String())
+	}
+
+	buf.Reset()
+	table.Border = true
+	err = table.Render(&buf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "+------+-------+\n" +
+		"| name | value |\n" +
+		"+------+-------+\n" +
+		"| a    |     1 |\n" +
+		"| 日本 |   100 |\n" +
+		"+------+-------+\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s\n", expected, buf.String())
+	}
+}
+
+func Test_ParseVerticalTerminator(t *testing.T) {
+	cases := []struct {
+		in       string
+		out      string
+		vertical bool
+	}{
+		{"select * from foo", "select * from foo", false},
+		{"select * from foo;", "select * from foo;", false},
+		{"select * from foo\\G", "select * from foo;", true},
+		{"select * from foo\\G | less", "select * from foo;| less", true},
+		{"select * from foo \\G> out.txt", "select * from foo ;> out.txt", true},
+		{"select * from foo where a = '\\G | x' \\G", "select * from foo where a = '\\G | x' ;", true},
+		{"select * from /\\G/ \\G | grep '\\G'", "select * from /\\G/ ;| grep '\\G'", true},
+		{"select * from foo where a = '\\G'", "select * from foo where a = '\\G'", false},
+	}
+	for _, c := range cases {
+		out, vertical := parseVerticalTerminator(c.in)
+		if out != c.out || vertical != c.vertical {
+			t.Errorf("parseVerticalTerminator(%q): expected (%q, %t), got (%q, %t)", c.in, c.out, c.vertical, out, vertical)
+		}
+	}
+}
+
+func Test_PrintVertical(t *testing.T) {
+	serie := &client.Series{
+		Name:    "foo",
+		Columns: []string{"time", "sequence_number", "value"},
+		Points:  [][]interface{}{{float64(1406231160000), float64(1), "a"}, {float64(1406231170000), float64(2), "b"}},
+	}
+	var buf bytes.Buffer
+	err := printVertical(&buf, serie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "*** foo: row 1 ***\n" +
+		"time            | 1406231160000\n" +
+		"sequence_number | 1\n" +
+		"value           | a\n" +
+		"*** foo: row 2 ***\n" +
+		"time            | 1406231170000\n" +
+		"sequence_number | 2\n" +
+		"value           | b\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s\n", expected, buf.String())
+	}
+}
+
+func Test_ParseImportCsv(t *testing.T) {
+	re := regexp.MustCompile(regexImportCsv)
+	regexTest(re,
+		"import csv /tmp/data.csv into foo",
+		[]string{"import csv /tmp/data.csv into foo", "/tmp/data.csv", "foo", "", "", ""},
+		t)
+	regexTest(re,
+		"import csv data.csv into \"foo.bar\" columns (ts, value) time column ts precision s",
+		[]string{"import csv data.csv into \"foo.bar\" columns (ts, value) time column ts precision s", "data.csv", "\"foo.bar\"", "ts, value", "ts", "s"},
+		t)
+	regexTest(re,
+		"import csv \"my data.csv\" into foo",
+		[]string{"import csv \"my data.csv\" into foo", "\"my data.csv\"", "foo", "", "", ""},
+		t)
+}
+
+func Test_ImportCsv(t *testing.T) {
+	var written []*client.Series
+	var precision string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		precision = r.URL.Query().Get("time_precision")
+		var series []*client.Series
+		if err := json.NewDecoder(r.Body).Decode(&series); err != nil {
+			t.Error(err)
+		}
+		written = append(written, series...)
+	}))
+	defer srv.Close()
+	var err error
+	cl, err = client.NewClient(&client.ClientConfig{Host: srv.Listener.Addr().String(), Database: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "influx-cli import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("ts,host,value\n1406231160,a,1\n1406231170,b\n1406231180,\"c,d\",2.5\n")
+	f.Close()
+
+	var buf bytes.Buffer
+	cmd := "import csv \"" + f.Name() + "\" into foo time column ts precision s"
+	_, err = importCsvHandler(regexp.MustCompile(regexImportCsv).FindStringSubmatch(cmd), &buf)
+	if err == nil {
+		t.Errorf("expected error for the line with missing values")
+	}
+
+	if precision != "s" {
+		t.Errorf("expected time_precision s, got %q", precision)
+	}
+	expected := []*client.Series{{
+		Name:    "foo",
+		Columns: []string{"time", "host", "value"},
+		Points:  [][]interface{}{{float64(1406231160), "a", float64(1)}, {float64(1406231180), "c,d", 2.5}},
+	}}
+	if !reflect.DeepEqual(written, expected) {
+		t.Errorf("expected: %v\ngot     : %v\n", spew.Sdump(expected), spew.Sdump(written))
+	}
+	if !strings.Contains(buf.String(), "imported 2 rows") || !strings.Contains(buf.String(), "1 errors") {
+		t.Errorf("unexpected report: %q", buf.String())
+	}
+}
+
+func Test_ImportCsvAsyncTimeHeader(t *testing.T) {
+	defer func(c *client.Client, a bool, s *Spool) { cl, async, spool = c, a, s }(cl, async, spool)
+	var written []*client.Series
+	var precision string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		precision = r.URL.Query().Get("time_precision")
+		var series []*client.Series
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&series); err != nil {
+			t.Error(err)
+		}
+		written = append(written, series...)
+	}))
+	defer srv.Close()
+	var err error
+	cl, err = client.NewClient(&client.ClientConfig{Host: srv.Listener.Addr().String(), Database: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "influx-cli-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("time,value\n1406231160000,1\n")
+	f.Close()
+
+	async, spool = true, nil
+	go committer()
+	cmd := "import csv " + f.Name() + " into foo"
+	_, err = importCsvHandler(regexp.MustCompile(regexImportCsv).FindStringSubmatch(cmd), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(asyncInserts)
+	<-asyncInsertsCommitted
+	asyncInserts = make(chan *client.Series)
+
+	if precision != "u" {
+		t.Errorf("expected time_precision u, got %q", precision)
+	}
+	expected := []*client.Series{{
+		Name:    "foo",
+		Columns: []string{"time", "value"},
+		Points:  [][]interface{}{{json.Number("1406231160000000"), json.Number("1")}},
+	}}
+	if !reflect.DeepEqual(written, expected) {
+		t.Errorf("expected: %v\ngot     : %v\n", spew.Sdump(expected), spew.Sdump(written))
+	}
+}
+
+func Test_SplitTuples(t *testing.T) {
+	cases := map[string][]string{
+		"1406231160000, 0, 10":         {"1406231160000, 0, 10"},
+		"1,2,3),(4,5,6":                {"1,2,3", "4,5,6"},
+		"1,2) , (3,4":                  {"1,2", "3,4"},
+		"1,\"a),(b\"),(2,\"avg(x,1)\"": {"1,\"a),(b\"", "2,\"avg(x,1)\""},
+	}
+	for in, expected := range cases {
+		got := splitTuples(in)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("splitTuples(%q): expected %q, got %q", in, expected, got)
+		}
+	}
+	re := regexp.MustCompile(regexInsert)
+	regexTest(re,
+		"insert into demo values (1406231160000, 0, 10),(1406231170000, 0, 11)",
+		[]string{"insert into demo values (1406231160000, 0, 10),(1406231170000, 0, 11)", "demo", "", "1406231160000, 0, 10),(1406231170000, 0, 11"},
+		t)
+}
+
+func Test_ParseTime(t *testing.T) {
+	cases := []struct {
+		in        string
+		ts        int64
+		precision client.TimePrecision
+	}{
+		{"1406231160000", 1406231160000, client.Millisecond},
+		{" 1406231160s", 1406231160, client.Second},
+		{"1406231160000ms", 1406231160000, client.Millisecond},
+		{"1406231160000000u", 1406231160000000, client.Microsecond},
+		{"2014-07-24T19:46:00Z", 1406231160000, client.Millisecond},
+		{"2014-07-24T19:46:00.000001Z", 1406231160000001, client.Microsecond},
+	}
+	for _, c := range cases {
+		ts, precision, err := parseTime(c.in, client.Millisecond)
+		if err != nil {
+			t.Errorf("parseTime(%q): %s", c.in, err)
+			continue
+		}
+		if ts != c.ts || precision != c.precision {
+			t.Errorf("parseTime(%q): expected (%d, %s), got (%d, %s)", c.in, c.ts, c.precision, ts, precision)
+		}
+	}
+
+	before := time.Now().Add(-time.Hour).UnixNano() / int64(time.Microsecond)
+	ts, precision, err := parseTime("now() - 1h", client.Millisecond)
+	after := time.Now().Add(-time.Hour).UnixNano() / int64(time.Microsecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts = convertTime(ts, precision, client.Microsecond)
+	if ts < before/1000*1000 || ts > after {
+		t.Errorf("parseTime(now() - 1h): %d not between %d and %d", ts, before, after)
+	}
+
+	_, _, err = parseTime("yesterday", client.Millisecond)
+	if err == nil {
+		t.Errorf("parseTime(yesterday): expected error")
+	}
+
+	if got := convertTime(1406231160, client.Second, client.Microsecond); got != 1406231160000000 {
+		t.Errorf("convertTime: expected 1406231160000000, got %d", got)
+	}
+}
+
+func Test_ParseUserCommands(t *testing.T) {
+	regexTest(regexp.MustCompile(regexListUsers),
+		"list users",
+		[]string{"list users", ""},
+		t)
+	regexTest(regexp.MustCompile(regexListUsers),
+		"list users mydb",
+		[]string{"list users mydb", "mydb"},
+		t)
+	regexTest(regexp.MustCompile(regexSetPermissions),
+		"set permissions dieter read '^foo\\..*' write '.*'",
+		[]string{"set permissions dieter read '^foo\\..*' write '.*'", "dieter", "^foo\\..*", ".*"},
+		t)
+}
+
+func Test_ParseShardSpaceOptions(t *testing.T) {
+	re := regexp.MustCompile(regexCreateShardSpace)
+	cmd := "create shardspace mydb hourly regex '/^hourly\\..*/' retention 30d duration 1h replication 2 split 3"
+	matches := re.FindStringSubmatch(cmd)
+	if len(matches) != 4 {
+		t.Fatalf("could not match %q", cmd)
+	}
+	space := &client.ShardSpace{Name: matches[2], Database: matches[1]}
+	err := parseShardSpaceOptions(matches[3], space)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &client.ShardSpace{
+		Name:              "hourly",
+		Database:          "mydb",
+		Regex:             "/^hourly\\..*/",
+		RetentionPolicy:   "30d",
+		ShardDuration:     "1h",
+		ReplicationFactor: 2,
+		Split:             3,
+	}
+	if !reflect.DeepEqual(space, expected) {
+		t.Errorf("expected: %v\ngot     : %v\n", spew.Sdump(expected), spew.Sdump(space))
+	}
+	if err := parseShardSpaceOptions("split many", space); err == nil {
+		t.Errorf("expected error for non-numeric split")
+	}
+	if err := parseShardSpaceOptions("regex /foo/", space); err == nil {
+		t.Errorf("expected error for unquoted regex")
+	}
+
+	regexTest(regexp.MustCompile(regexDropShard),
+		"drop shard 12 1 2",
+		[]string{"drop shard 12 1 2", "12", " 1 2"},
+		t)
+}
+
+func Test_Completions(t *testing.T) {
+	initKeywords()
+	cachedDbs = []string{"graphite", "grafana", "stats"}
+	cachedSeries = []string{"foo.bar", "foo.baz", "quux"}
+	cachedColumns["foo.bar"] = []string{"time", "sequence_number", "value", "host"}
+
+	cases := []struct {
+		line     string
+		start    int
+		word     string
+		expected []string
+	}{
+		{"li", 0, "li", []string{"list"}},
+		{"list sh", 5, "sh", []string{"shards", "shardspaces"}},
+		{"create ", 7, "", []string{"admin", "db", "shardspace", "user"}},
+		{"\\fo", 0, "\\fo", []string{"\\format"}},
+		{"\\format j", 8, "j", []string{"json"}},
+		{"\\db gra", 4, "gra", []string{"graphite", "grafana"}},
+		{"delete db st", 10, "st", []string{"stats"}},
+		{"select * from foo.", 14, "foo.", []string{"foo.bar", "foo.baz"}},
+		{"insert into q", 12, "q", []string{"quux"}},
+		{"drop series f", 12, "f", []string{"foo.bar", "foo.baz"}},
+		{"select v from foo.bar", 7, "v", []string{"value"}},
+		{"select value, h from \"foo.bar\" where", 14, "h", []string{"host"}},
+		{"select * from foo.bar where h", 28, "h", []string{"host"}},
+		{"select value from \"foo.bar\" group by v", 37, "v", []string{"value"}},
+	}
+	for _, c := range cases {
+		got := completions(c.line, c.start, c.word)
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("completions(%q, %d, %q): expected %q, got %q", c.line, c.start, c.word, c.expected, got)
+		}
+	}
+
+	forgetSeries("foo.bar")
+	if _, ok := cachedColumns["foo.bar"]; ok || cachedSeries != nil {
+		t.Errorf("expected the columns and series list to be forgotten")
+	}
+	cachedDbs = []string{"graphite"}
+	cachedColumns["quux"] = []string{"value"}
+	clearCompletionCache()
+	if cachedDbs != nil || len(cachedColumns) != 0 {
+		t.Errorf("expected the completion cache to be cleared")
+	}
+}
+
+func Test_StatementBuffer(t *testing.T) {
+	input := []string{
+		"list series",
+		"select mean(value)",
+		"from foo",
+		"group by time(1m);",
+		"\\t",
+		"select * from bar",
+		"insert into foo values (1, 2),",
+		"(3, \"a;",
+		"b\")",
+		"select 'x;y' from baz where",
+		"value > 5 \\G | less",
+		"select * from quux",
+	}
+	expected := []string{
+		"list series",
+		"select mean(value) from foo group by time(1m);",
+		"\\t",
+		"select * from bar",
+		"insert into foo values (1, 2), (3, \"a; b\")",
+		"select 'x;y' from baz where value > 5 \\G | less",
+	}
+	expectedLines := []int{1, 2, 5, 6, 7, 10}
+	var buf StatementBuffer
+	got := make([]string, 0)
+	gotLines := make([]int, 0)
+	for _, line := range input {
+		for _, stmt := range buf.Add(line) {
+			got = append(got, stmt.Text)
+			gotLines = append(gotLines, stmt.Line)
+		}
+	}
+	if !reflect.DeepEqual(gotLines, expectedLines) {
+		t.Errorf("expected lines %v, got %v", expectedLines, gotLines)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected: %v\ngot     : %v\n", spew.Sdump(expected), spew.Sdump(got))
+	}
+	if !buf.Pending() || buf.Flush() != "select * from quux" {
+		t.Errorf("expected pending statement 'select * from quux'")
+	}
+}
+
+func Test_StatementBufferUnbalancedQuotes(t *testing.T) {
+	input := []string{
+		"echo it's done",
+		"create admin bob p\"ss",
+		"select * from \"foo",
+		"list series",
+		"bar\";",
+		"select * from 'baz",
+		"\\t",
+	}
+	expected := []string{
+		"echo it's done",
+		"create admin bob p\"ss",
+		"select * from \"foo list series bar\";",
+		"select * from 'baz",
+		"\\t",
+	}
+	var buf StatementBuffer
+	got := make([]string, 0)
+	for _, line := range input {
+		for _, stmt := range buf.Add(line) {
+			got = append(got, stmt.Text)
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected: %v\ngot     : %v\n", spew.Sdump(expected), spew.Sdump(got))
+	}
+}
+
+func Test_RunScript(t *testing.T) {
+	f, err := ioutil.TempFile("", "influx-cli-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("echo one\necho two;\n")
+	f.Close()
+	if !runScript(f.Name()) {
+		t.Errorf("expected script to succeed")
+	}
+
+	f, err = os.Create(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("echo one\nbogus command\necho two\n")
+	f.Close()
+	if runScript(f.Name()) {
+		t.Errorf("expected script with unknown command to fail")
+	}
+	if runScript(f.Name() + ".doesnotexist") {
+		t.Errorf("expected missing script to fail")
+	}
+}
+
+func Test_HandleReportsFailure(t *testing.T) {
+	if !handle("\\format csv") {
+		t.Errorf("expected valid option to succeed")
+	}
+	if handle("\\format bogus") {
+		t.Errorf("expected invalid format to fail")
+	}
+	if handle("\\nosuchoption") {
+		t.Errorf("expected unrecognized option to fail")
+	}
+	format = "table"
+}
+
+func Test_RetryAndDeadLetter(t *testing.T) {
+	defer func(c *client.Client, w time.Duration, r int, d string) {
+		cl, AsyncRetryWait, AsyncRetries, path_deadletter = c, w, r, d
+	}(cl, AsyncRetryWait, AsyncRetries, path_deadletter)
+	requests := 0
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= 2 {
+			http.Error(w, "server restarting", http.StatusServiceUnavailable)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer srv.Close()
+	var err error
+	cl, err = client.NewClient(&client.ClientConfig{Host: srv.Listener.Addr().String(), Database: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AsyncRetryWait = time.Millisecond
+	series := []*client.Series{{Name: "foo", Columns: []string{"time", "value"}, Points: [][]interface{}{{int64(1406231160000001), int64(9007199254740993)}}}}
+
+	AsyncRetries = 1
+	if err := writeWithRetry(series, client.Microsecond); err == nil {
+		t.Errorf("expected write to fail with only 1 retry")
+	}
+	AsyncRetries = 3
+	requests = 0
+	if err := writeWithRetry(series, client.Microsecond); err != nil {
+		t.Errorf("expected write to succeed on the third attempt: %s", err)
+	}
+	if budget := retryBudget(); budget != 7*time.Millisecond {
+		t.Errorf("expected a retry budget of 7ms, got %s", budget)
+	}
+	if exitTimeout() <= retryBudget() {
+		t.Errorf("expected the exit timeout to cover the retry budget")
+	}
+
+	f, err := ioutil.TempFile("", "influx-cli-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	path_deadletter = f.Name()
+	if err := writeDeadLetter(series, client.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	body = ""
+	var buf bytes.Buffer
+	_, err = replayDeadLetterHandler([]string{"replay deadletter", ""}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"name":"foo","columns":["time","value"],"points":[[1406231160000001,9007199254740993]]}]`
+	if body != expected {
+		t.Errorf("expected replayed body %s, got %s", expected, body)
+	}
+	if !strings.Contains(buf.String(), "replayed 1 batches") {
+		t.Errorf("unexpected report: %q", buf.String())
+	}
+}
+
+func Test_Spool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx-cli-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &client.Series{Name: "a", Columns: []string{"value"}, Points: [][]interface{}{{json.Number("1")}}}
+	b := &client.Series{Name: "b", Columns: []string{"value"}, Points: [][]interface{}{{"x"}}}
+	for _, serie := range []*client.Series{a, b} {
+		if err := s.Append(serie); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// simulate a crash halfway writing an insert
+	s.fd.WriteString(`{"name":"c","colu`)
+
+	if _, err := OpenSpool(dir); err == nil {
+		t.Errorf("expected the spool to be locked while open")
+	}
+	s.Close()
+	s, err = OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	series, err := s.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(series, []*client.Series{a, b}) {
+		t.Errorf("expected: %v\ngot     : %v\n", spew.Sdump([]*client.Series{a, b}), spew.Sdump(series))
+	}
+	if err := s.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(b); err != nil {
+		t.Fatal(err)
+	}
+	series, err = s.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(series, []*client.Series{b}) {
+		t.Errorf("expected only b after truncate, got %v", spew.Sdump(series))
+	}
+}
+
+func Test_CoalesceSeries(t *testing.T) {
+	in := []*client.Series{
+		{Name: "a", Columns: []string{"time", "value"}, Points: [][]interface{}{{1, 1}}},
+		{Name: "b", Columns: []string{"value"}, Points: [][]interface{}{{2}}},
+		{Name: "a", Columns: []string{"time", "value"}, Points: [][]interface{}{{3, 3}}},
+		{Name: "a", Columns: []string{"value", "time"}, Points: [][]interface{}{{4, 4}}},
+		{Name: "b", Columns: []string{"value"}, Points: [][]interface{}{{5}, {6}}},
+	}
+	expected := []*client.Series{
+		{Name: "a", Columns: []string{"time", "value"}, Points: [][]interface{}{{1, 1}, {3, 3}}},
+		{Name: "b", Columns: []string{"value"}, Points: [][]interface{}{{2}, {5}, {6}}},
+		{Name: "a", Columns: []string{"value", "time"}, Points: [][]interface{}{{4, 4}}},
+	}
+	got := coalesceSeries(in)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected: %v\ngot     : %v\n", spew.Sdump(expected), spew.Sdump(got))
+	}
+	if len(in[0].Points) != 1 || len(in[1].Points) != 1 {
+		t.Errorf("coalesceSeries should not modify its input")
+	}
+	if payloadSize(got) >= payloadSize(in) {
+		t.Errorf("expected coalesced payload (%d) to be smaller than the original (%d)", payloadSize(got), payloadSize(in))
+	}
+}
+
+func Test_Stats(t *testing.T) {
+	if name := handlerName(selectHandler); name != "select" {
+		t.Errorf("expected handler name select, got %q", name)
+	}
+	names := map[string]string{
+		"list series":       "list_series",
+		"\\format csv":      "option_format",
+		"\\t":               "option_t",
+		"select * from foo": "select",
+	}
+	for cmd, expected := range names {
+		for _, spec := range handlers {
+			if m := regexp.MustCompile(spec.Match).FindStringSubmatch(cmd); m != nil {
+				if name := statsName(spec, m); name != expected {
+					t.Errorf("statsName for %q: expected %q, got %q", cmd, expected, name)
+				}
+			}
+		}
+	}
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("queries", r).Inc(3)
+	timer := metrics.GetOrRegisterTimer("insert_sync", r)
+	timer.Update(2 * time.Millisecond)
+	timer.Update(4 * time.Millisecond)
+	h := metrics.GetOrRegisterHistogram("payload", r, metrics.NewUniformSample(10))
+	h.Update(10)
+	h.Update(20)
+
+	serie := statsSeries(r)
+	if len(serie.Points) != 3 {
+		t.Fatalf("expected 3 metrics, got %v", spew.Sdump(serie))
+	}
+	// sorted by name
+	expected := []interface{}{"insert_sync", "timer", int64(2), "3ms", "3ms", "4ms", "4ms"}
+	if !reflect.DeepEqual(serie.Points[0][:7], expected) {
+		t.Errorf("expected: %v\ngot     : %v\n", expected, serie.Points[0][:7])
+	}
+	expected = []interface{}{"payload", "histogram", int64(2), 15.0, 15.0, 20.0, 20.0, nil}
+	if !reflect.DeepEqual(serie.Points[1], expected) {
+		t.Errorf("expected: %v\ngot     : %v\n", expected, serie.Points[1])
+	}
+	expected = []interface{}{"queries", "counter", int64(3), nil, nil, nil, nil, nil}
+	if !reflect.DeepEqual(serie.Points[2], expected) {
+		t.Errorf("expected: %v\ngot     : %v\n", expected, serie.Points[2])
+	}
+}
+
+func Test_MetricsOut(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("queries", r).Inc(2)
+	metrics.GetOrRegisterTimer("insert_sync", r).Update(4 * time.Millisecond)
+	now := time.Unix(1400000000, 0)
+
+	// graphite
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		data, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		received <- string(data)
+	}()
+	w, err := newMetricsWriter("tcp://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w(r, now); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(<-received), "\n")
+	sort.Strings(lines)
+	expected := []string{
+		"influx-cli.insert_sync.count 1 1400000000",
+		"influx-cli.insert_sync.mean 4 1400000000",
+		"influx-cli.insert_sync.p50 4 1400000000",
+		"influx-cli.insert_sync.p95 4 1400000000",
+		"influx-cli.insert_sync.p99 4 1400000000",
+		"influx-cli.queries.count 2 1400000000",
+	}
+	// the rate depends on timing, so just check it's there
+	if len(lines) != len(expected)+1 || !strings.HasPrefix(lines[len(lines)-2], "influx-cli.insert_sync.rate ") {
+		t.Fatalf("unexpected graphite output: %v", lines)
+	}
+	lines = append(lines[:len(lines)-2], lines[len(lines)-1])
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected: %v\ngot     : %v\n", expected, lines)
+	}
+
+	// json lines
+	dir, err := ioutil.TempDir("", "influx-cli-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "metrics.json")
+	w, err = newMetricsWriter(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w(r, now)
+	w(r, now)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonLines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(jsonLines) != 2 {
+		t.Fatalf("expected 2 json lines, got %q", data)
+	}
+	var doc struct {
+		Time    int64
+		Metrics map[string]map[string]float64
+	}
+	if err := json.Unmarshal([]byte(jsonLines[1]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Time != 1400000000 || doc.Metrics["queries"]["count"] != 2 || doc.Metrics["insert_sync"]["p99"] != 4 {
+		t.Errorf("unexpected json line: %s", jsonLines[1])
+	}
+}
+
+func Test_SetRcKeys(t *testing.T) {
+	keys := []string{"host", "db"}
+	values := map[string]string{"host": "\"prod\"", "db": "\"metrics\""}
+
+	rc := `host = "localhost" # old
+asyncCapacity = 100
+
+[profiles.staging]
+host = "staging"
+`
+	expected := `host = "prod"
+asyncCapacity = 100
+db = "metrics"
+
+[profiles.staging]
+host = "staging"
+`
+	if got := setRcKeys(rc, "", keys, values); got != expected {
+		t.Errorf("top level: expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	expected = `host = "localhost" # old
+asyncCapacity = 100
+
+[profiles.staging]
+host = "prod"
+db = "metrics"
+`
+	if got := setRcKeys(rc, "profiles.staging", keys, values); got != expected {
+		t.Errorf("existing profile: expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	expected = rc + `
+[profiles.prod]
+host = "prod"
+db = "metrics"
+`
+	got := setRcKeys(rc, "profiles.prod", keys, values)
+	if got != expected {
+		t.Errorf("new profile: expected:\n%s\ngot:\n%s", expected, got)
+	}
+	var conf Config
+	if _, err := toml.Decode(got, &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Host != "localhost" || conf.Profiles["staging"].Host != "staging" || conf.Profiles["prod"].Db != "metrics" {
+		t.Errorf("unexpected config after decoding: %v", spew.Sdump(conf))
+	}
+
+	if got := setRcKeys("", "profiles.prod", keys, values); got != "[profiles.prod]\nhost = \"prod\"\ndb = \"metrics\"\n" {
+		t.Errorf("empty rc: got:\n%s", got)
+	}
+}
+
+func Test_ApplyProfile(t *testing.T) {
+	defer func(h string, p int, u, d string) { host, port, user, db = h, p, u, d }(host, port, user, db)
+	host, port, user, db = "localhost", 8086, "root", ""
+	applyProfile(Profile{Host: "prod", Port: 8087, Db: "metrics"}, map[string]bool{"db": true})
+	if host != "prod" || port != 8087 || user != "root" || db != "" {
+		t.Errorf("unexpected parameters after applying profile: %s %d %s %q", host, port, user, db)
+	}
+	regexTest(regexp.MustCompile(regexWriteRc), "writerc", []string{"writerc", ""}, t)
+	regexTest(regexp.MustCompile(regexWriteRc), "writerc prod", []string{"writerc prod", "prod"}, t)
+}
+
+func Test_Tls(t *testing.T) {
+	defer func(h string, p int, s bool, ca, cc, ck string, skip bool) {
+		host, port, ssl, caCert, clientCert, clientKey, insecureSkipVerify = h, p, s, ca, cc, ck, skip
+	}(host, port, ssl, caCert, clientCert, clientKey, insecureSkipVerify)
+
+	var peerCerts int
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerCerts = len(r.TLS.PeerCertificates)
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	// the server's own certificate serves as CA, as well as client certificate
+	dir, err := ioutil.TempDir("", "influx-cli-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert := ts.TLS.Certificates[0]
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+
+	u, _ := url.Parse(ts.URL)
+	h, p, _ := net.SplitHostPort(u.Host)
+	host = h
+	port, _ = strconv.Atoi(p)
+	ssl = true
+
+	caCert, clientCert, clientKey, insecureSkipVerify = "", "", "", false
+	if err := getClient(); err == nil {
+		t.Errorf("expected an error for an unknown CA")
+	}
+
+	insecureSkipVerify = true
+	if err := getClient(); err != nil {
+		t.Errorf("expected no error with insecure-skip-verify, got %s", err.Error())
+	}
+
+	caCert, insecureSkipVerify = certFile, false
+	if err := getClient(); err != nil {
+		t.Errorf("expected no error with ca-cert, got %s", err.Error())
+	}
+	if peerCerts != 0 {
+		t.Errorf("expected no client certificate, got %d", peerCerts)
+	}
+	if !cfg.IsSecure {
+		t.Errorf("expected a secure connection")
+	}
+
+	clientCert = certFile
+	if err := getClient(); err == nil {
+		t.Errorf("expected an error for client-cert without client-key")
+	}
+	clientKey = keyFile
+	if err := getClient(); err != nil {
+		t.Errorf("expected no error with client cert, got %s", err.Error())
+	}
+	if peerCerts != 1 {
+		t.Errorf("expected the client certificate to be sent, got %d", peerCerts)
+	}
+}
+
+func Test_Udp(t *testing.T) {
+	defer func(h string, p, up int, u, a bool, c *client.Client) {
+		host, port, udpPort, udp, async, cl = h, p, up, u, a, c
+	}(host, port, udpPort, udp, async, cl)
+
+	// http is only used to ping
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ping" {
+			t.Errorf("unexpected http request %s", r.URL)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	u, _ := url.Parse(ts.URL)
+	h, p, _ := net.SplitHostPort(u.Host)
+	host = h
+	port, _ = strconv.Atoi(p)
+	udpPort = ln.LocalAddr().(*net.UDPAddr).Port
+	if err := getClient(); err != nil {
+		t.Fatal(err)
+	}
+	udp, async = true, false
+
+	_, err = insertHandler(regexp.MustCompile(regexInsert).FindStringSubmatch("insert into foo (time, value) values (1400000000s, 1), (1400000001000, 2)"), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65536)
+	ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := ln.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []*client.Series
+	dec := json.NewDecoder(bytes.NewReader(buf[:n]))
+	dec.UseNumber()
+	if err := dec.Decode(&series); err != nil {
+		t.Fatalf("could not decode udp payload %q: %s", buf[:n], err.Error())
+	}
+	expected := []*client.Series{{
+		Name:    "foo",
+		Columns: []string{"time", "value"},
+		Points:  [][]interface{}{{json.Number("1400000000000"), json.Number("1")}, {json.Number("1400000001000"), json.Number("2")}},
+	}}
+	if !reflect.DeepEqual(series, expected) {
+		t.Errorf("expected: %v\ngot     : %v\n", spew.Sdump(expected), spew.Sdump(series))
+	}
+}
+
+func Test_UdpLargeBatch(t *testing.T) {
+	defer func(h string, up int, u bool, c *client.Client) {
+		host, udpPort, udp, udpCl = h, up, u, c
+	}(host, udpPort, udp, udpCl)
+
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	host = "127.0.0.1"
+	udpPort = ln.LocalAddr().(*net.UDPAddr).Port
+	if err := getUdpClient(); err != nil {
+		t.Fatal(err)
+	}
+	udp = true
+
+	// two series of 100 points with ~40 byte values: about 10KB of json
+	batch := make([]*client.Series, 0)
+	for _, name := range []string{"foo", "bar"} {
+		serie := &client.Series{Name: name, Columns: []string{"time", "value"}}
+		for i := 0; i < 100; i++ {
+			serie.Points = append(serie.Points, []interface{}{int64(1400000000000 + i), strings.Repeat("x", 40)})
+		}
+		batch = append(batch, serie)
+	}
+	if err := writeSeries(batch, client.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	points := map[string]int{}
+	datagrams := 0
+	buf := make([]byte, 65536)
+	for points["foo"]+points["bar"] < 200 {
+		ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := ln.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got %d of 200 points: %s", points["foo"]+points["bar"], err.Error())
+		}
+		datagrams++
+		if n >= udpMaxMessageSize {
+			t.Errorf("datagram of %d bytes, should be under %d", n, udpMaxMessageSize)
+		}
+		var series []*client.Series
+		if err := json.Unmarshal(buf[:n], &series); err != nil {
+			t.Fatalf("could not decode udp payload %q: %s", buf[:n], err.Error())
+		}
+		for _, serie := range series {
+			points[serie.Name] += len(serie.Points)
+		}
+	}
+	if points["foo"] != 100 || points["bar"] != 100 {
+		t.Errorf("expected 100 points of each series, got %v", points)
+	}
+	if datagrams < 5 {
+		t.Errorf("expected the batch to be split in at least 5 datagrams, got %d", datagrams)
+	}
+
+	huge := []*client.Series{{Name: "foo", Columns: []string{"value"}, Points: [][]interface{}{{strings.Repeat("x", 4096)}}}}
+	if err := writeSeries(huge, client.Millisecond); err == nil {
+		t.Error("expected an error for a point that doesn't fit in a datagram")
+	}
+}
+
+func Test_ScriptNotInteractive(t *testing.T) {
+	defer func(y, s, i bool, c *client.Client) { assumeYes, safe, interactive, cl = y, s, i, c }(assumeYes, safe, interactive, cl)
+	var deleted string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleted = r.Method + " " + r.URL.Path
+	}))
+	defer srv.Close()
+	var err error
+	cl, err = client.NewClient(&client.ClientConfig{Host: srv.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "influx-cli-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("delete db foo\n")
+	f.Close()
+
+	// sourced from the prompt, the script still doesn't ask
+	assumeYes, safe, interactive = false, false, true
+	if !runScript(f.Name()) {
+		t.Errorf("expected the script to run without confirmation")
+	}
+	if deleted != "DELETE /db/foo" {
+		t.Errorf("expected the db to be deleted, got %q", deleted)
+	}
+	if !interactive {
+		t.Errorf("expected interactive to be restored after the script")
+	}
+}
+
+func Test_Confirm(t *testing.T) {
+	defer func(y, s bool) { assumeYes, safe = y, s }(assumeYes, safe)
+	assumeYes, safe = false, false
+
+	var prompts []string
+	answer := func(lines ...string) func(string) (string, bool) {
+		return func(prompt string) (string, bool) {
+			prompts = append(prompts, prompt)
+			if len(lines) == 0 {
+				return "", false
+			}
+			line := lines[0]
+			lines = lines[1:]
+			return line, true
+		}
+	}
+	if err := confirm("delete db", "foo", answer("foo"), true); err != nil {
+		t.Errorf("expected confirmation, got %s", err.Error())
+	}
+	if len(prompts) != 1 || !strings.Contains(prompts[0], `type "foo" to confirm`) {
+		t.Errorf("unexpected prompts %q", prompts)
+	}
+	if err := confirm("delete db", "foo", answer("fo"), true); err == nil {
+		t.Errorf("expected a typo not to confirm")
+	}
+	if err := confirm("delete db", "foo", answer(), true); err == nil {
+		t.Errorf("expected no input not to confirm")
+	}
+	prompts = nil
+	if err := confirm("delete db", "foo", answer(), false); err != nil {
+		t.Errorf("expected no confirmation needed when not interactive, got %s", err.Error())
+	}
+	if len(prompts) != 0 {
+		t.Errorf("expected no prompt when not interactive, got %q", prompts)
+	}
+	assumeYes = true
+	if err := confirm("delete db", "foo", answer(), true); err != nil {
+		t.Errorf("expected no confirmation needed with -yes, got %s", err.Error())
+	}
+	safe = true
+	if err := confirm("delete db", "foo", answer("foo"), true); err == nil {
+		t.Errorf("expected safe mode to refuse")
+	}
+	if _, err := deleteDbHandler([]string{"delete db foo", "foo"}, ioutil.Discard); err == nil {
+		t.Errorf("expected safe mode to refuse delete db")
+	}
+}
+
+func Test_ReadOnly(t *testing.T) {
+	defer func(r bool, c *client.Client) { readOnly, cl = r, c }(readOnly, cl)
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("[]"))
+	}))
+	defer ts.Close()
+	var err error
+	cl, err = client.NewClient(&client.ClientConfig{Host: strings.TrimPrefix(ts.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readOnly = true
+	for _, cmd := range []string{
+		"create db foo",
+		"delete db foo",
+		"drop series foo",
+		"insert into foo (value) values (1)",
+		"update admin foo bar",
+		"delete server 1",
+		"writerc",
+		"raw drop continuous query 1",
+		"select * from foo into bar",
+	} {
+		if handle(cmd) {
+			t.Errorf("expected %q to be rejected in read-only mode", cmd)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("expected no requests in read-only mode, got %d", requests)
+	}
+	for _, spec := range handlers {
+		if spec.Access == Read && regexp.MustCompile(spec.Match).MatchString("insert into foo values (1)") {
+			t.Errorf("expected insert to be a write handler")
+		}
+	}
+	if !handle("ping") || requests != 1 {
+		t.Errorf("expected ping to be allowed in read-only mode")
+	}
+
+	cases := map[string]bool{
+		"select * from foo into bar":                                          true,
+		"select mean(value) from /.*/ group by time(1h) into 1h.:series_name": true,
+		"select * from foo where msg = 'into'":                                false,
+		"select * from \"into\"":                                              false,
+		"select * from into where value > 1":                                  false,
+		"select * from foo where msg = 'a \\' into b'":                        false,
+	}
+	for stmt, expected := range cases {
+		if isSelectInto(stmt) != expected {
+			t.Errorf("expected isSelectInto(%q) to be %t", stmt, expected)
+		}
+	}
+}
+
+func Test_ReadOnlyMessage(t *testing.T) {
+	defer func(r bool, stderr *os.File) { readOnly, os.Stderr = r, stderr }(readOnly, os.Stderr)
+	readOnly = true
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stderr = w
+	refused := metrics.GetOrRegisterCounter("handler_create_admin_refused", metrics.DefaultRegistry).Count()
+	calls := metrics.GetOrRegisterCounter("handler_create_admin_calls", metrics.DefaultRegistry).Count()
+	handle("create admin foo s3cret")
+	w.Close()
+	msg, _ := ioutil.ReadAll(r)
+	if strings.Contains(string(msg), "s3cret") || !strings.Contains(string(msg), "create admin") {
+		t.Errorf("unexpected read-only error %q", msg)
+	}
+	// a refusal is not a failed call
+	if metrics.GetOrRegisterCounter("handler_create_admin_refused", metrics.DefaultRegistry).Count() != refused+1 {
+		t.Errorf("expected the refusal to be counted")
+	}
+	if metrics.GetOrRegisterCounter("handler_create_admin_calls", metrics.DefaultRegistry).Count() != calls {
+		t.Errorf("expected the refused command not to count as a call")
+	}
+}
+
+func Test_Credentials(t *testing.T) {
+	for stmt, expected := range map[string]bool{
+		"\\pass secret":            true,
+		"create admin foo secret":  true,
+		"update admin foo secret":  true,
+		"create user foo secret":   true,
+		"\\profile production":     false,
+		"select * from passwords;": false,
+		"list admin":               false,
+	} {
+		if hasCredentials(stmt) != expected {
+			t.Errorf("expected hasCredentials(%q) to be %t", stmt, expected)
+		}
+	}
+	if maskPassword("secret") == "secret" || maskPassword("") != "" {
+		t.Errorf("unexpected password masks %q and %q", maskPassword("secret"), maskPassword(""))
+	}
+
+	dir, err := ioutil.TempDir("", "influx-cli-rc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { path_rc = p }(path_rc)
+	path_rc = filepath.Join(dir, "influxrc")
+
+	var out bytes.Buffer
+	if err := saveRc("", &out); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path_rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 || out.Len() != 0 {
+		t.Errorf("expected a new rc file with mode 0600 and no warning, got %#o and %q", info.Mode().Perm(), out.String())
+	}
+
+	os.Chmod(path_rc, 0644)
+	if err := saveRc("prod", &out); err != nil {
+		t.Fatal(err)
+	}
+	info, _ = os.Stat(path_rc)
+	if info.Mode().Perm() != 0600 || !strings.Contains(out.String(), "warning") {
+		t.Errorf("expected a warning and mode 0600, got %#o and %q", info.Mode().Perm(), out.String())
+	}
+}
+
+func Test_ResolvePass(t *testing.T) {
+	defer func(p, f string, pp bool, env string, pr string, b Profile) {
+		pass, passFile, passPrompt, profile, baseConn = p, f, pp, pr, b
+		os.Setenv("INFLUX_PASSWORD", env)
+	}(pass, passFile, passPrompt, os.Getenv("INFLUX_PASSWORD"), profile, baseConn)
+	profile = ""
+
+	dir, err := ioutil.TempDir("", "influx-cli-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "pass")
+	ioutil.WriteFile(file, []byte("from file&co\n"), 0600)
+
+	pass, passFile, passPrompt = "rc", "", false
+	os.Setenv("INFLUX_PASSWORD", "from env")
+	if err := resolveConn(map[string]bool{}); err != nil || pass != "from+env" {
+		t.Errorf("expected the password from INFLUX_PASSWORD, got %q (%v)", pass, err)
+	}
+
+	pass = "from flag"
+	if err := resolveConn(map[string]bool{"pass": true}); err != nil || pass != "from flag" {
+		t.Errorf("expected -pass to take precedence over INFLUX_PASSWORD, got %q (%v)", pass, err)
+	}
+
+	pass, passFile = "rc", file
+	if err := resolveConn(map[string]bool{"pass-file": true}); err != nil || pass != "from+file%26co" {
+		t.Errorf("expected the password from -pass-file, got %q (%v)", pass, err)
+	}
+
+	if err := resolveConn(map[string]bool{"pass": true, "pass-file": true}); err == nil {
+		t.Errorf("expected an error when combining -pass and -pass-file")
+	}
+}
+
+func Test_EnvPassPrecedence(t *testing.T) {
+	defer func(h, p, f string, pp bool, env string, pr string, prs map[string]Profile, b Profile) {
+		host, pass, passFile, passPrompt, profile, profiles, baseConn = h, p, f, pp, pr, prs, b
+		os.Setenv("INFLUX_PASSWORD", env)
+	}(host, pass, passFile, passPrompt, os.Getenv("INFLUX_PASSWORD"), profile, profiles, baseConn)
+	passFile, passPrompt = "", false
+	profiles = map[string]Profile{
+		"prod":   {Host: "influx-prod", Pass: "from profile"},
+		"nopass": {Host: "influx-nopass"},
+	}
+	os.Setenv("INFLUX_PASSWORD", "from env")
+
+	// the profile's pass wins over the env var
+	host, pass, profile, baseConn = "rc", "rc", "prod", Profile{Host: "rc", Pass: "rc"}
+	if err := resolveConn(map[string]bool{}); err != nil || pass != "from+profile" {
+		t.Errorf("expected the password from the profile, got %q (%v)", pass, err)
+	}
+	// the env var wins over the rc file, if the profile has no pass
+	pass, profile, baseConn = "rc", "nopass", Profile{Host: "rc", Pass: "rc"}
+	if err := resolveConn(map[string]bool{}); err != nil || pass != "from+env" || host != "influx-nopass" {
+		t.Errorf("expected the password from INFLUX_PASSWORD, got %q (%v)", pass, err)
+	}
+	// flags win over both
+	pass, profile = "from flag", "prod"
+	if err := resolveConn(map[string]bool{"pass": true}); err != nil || pass != "from flag" {
+		t.Errorf("expected the password from -pass, got %q (%v)", pass, err)
+	}
+	if err := resolveConn(map[string]bool{}); err != nil || baseConn.Pass != "from+env" {
+		t.Errorf("expected switching profiles to fall back to INFLUX_PASSWORD, got %q", baseConn.Pass)
+	}
+
+	profile = "nope"
+	if err := resolveConn(map[string]bool{}); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
+
+func Test_ReadStdinUnterminated(t *testing.T) {
+	defer func(stdin, stdout *os.File) { os.Stdin, os.Stdout = stdin, stdout }(os.Stdin, os.Stdout)
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdin, os.Stdout = inR, outW
+	// the open paren keeps the statement pending until EOF
+	inW.WriteString("echo first\necho (second")
+	inW.Close()
+	ok := readStdin()
+	outW.Close()
+	out, _ := ioutil.ReadAll(outR)
+	if !ok || string(out) != "first\n(second\n" {
+		t.Errorf("expected the unterminated statement to be executed at EOF, got %q", out)
+	}
+}
+
+func Test_SingleArgOptions(t *testing.T) {
+	defer func(d string) { db = d }(db)
+	db = "before"
+	re := regexp.MustCompile(regexOption)
+	if _, err := optionHandler(re.FindStringSubmatch("\\db foo bar"), ioutil.Discard); err == nil || db != "before" {
+		t.Errorf("expected \\db with two words to be rejected, db is now %q", db)
+	}
+	if _, err := optionHandler(re.FindStringSubmatch("\\db foo "), ioutil.Discard); err != nil || db != "foo" {
+		t.Errorf("expected db foo, got %q (%v)", db, err)
+	}
+}
+
+func Test_SourceRecursion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx-cli-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := filepath.Join(dir, "a.influx")
+	b := filepath.Join(dir, "b.influx")
+	ioutil.WriteFile(a, []byte("echo a\nsource "+b+"\n"), 0600)
+	ioutil.WriteFile(b, []byte("echo b\n\\i "+a+"\n"), 0600)
+	if runScript(a) {
+		t.Errorf("expected a script that sources itself to fail")
+	}
+	if len(runningScripts) != 0 {
+		t.Errorf("expected no scripts running afterwards, got %v", runningScripts)
+	}
+}
+
+func Test_ConfigAsyncRetries(t *testing.T) {
+	var conf Config
+	if _, err := toml.Decode("asyncRetries = 0\n", &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.AsyncRetries == nil || *conf.AsyncRetries != 0 {
+		t.Errorf("expected asyncRetries = 0 to be distinguishable from unset, got %v", conf.AsyncRetries)
+	}
+	conf = Config{}
+	if _, err := toml.Decode("asyncCapacity = 10\n", &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.AsyncRetries != nil {
+		t.Errorf("expected asyncRetries to be unset")
+	}
+}
+
+func Test_NoSpoolConfigured(t *testing.T) {
+	defer func(d string) { spoolDir = d }(spoolDir)
+	spoolDir = ""
+	applyConfig(Config{})
+	if spoolDir != "" {
+		t.Errorf("expected no spool, got %q", spoolDir)
+	}
+	if Expand("") != "" {
+		t.Errorf("expected Expand of an empty path to be empty")
+	}
+}
+
+func Test_SpoolBeforeAck(t *testing.T) {
+	defer func(s *Spool, c *client.Client, w time.Duration) { spool, cl, AsyncMaxWait = s, c, w }(spool, cl, AsyncMaxWait)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	var err error
+	cl, err = client.NewClient(&client.ClientConfig{Host: strings.TrimPrefix(ts.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "influx-cli-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err = OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	AsyncMaxWait = time.Hour
+	go committer()
+
+	serie := &client.Series{Name: "a", Columns: []string{"value"}, Points: [][]interface{}{{json.Number("1")}}}
+	if err := queueAsync(serie); err != nil {
+		t.Fatal(err)
+	}
+	// acknowledged, so it must be on disk already
+	series, err := spool.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(series, []*client.Series{serie}) {
+		t.Errorf("expected the insert in the spool, got %v", spew.Sdump(series))
+	}
+	forceInsertsFlush <- true
+	// once the committer picks up the next insert, the previous batch was written and the spool truncated
+	if err := queueAsync(serie); err != nil {
+		t.Fatal(err)
+	}
+	series, _ = spool.ReadAll()
+	if len(series) != 1 {
+		t.Errorf("expected only the new insert in the spool, got %v", spew.Sdump(series))
+	}
+	// stop the committer, so it's done writing before we restore the client
+	close(asyncInserts)
+	<-asyncInsertsCommitted
+	asyncInserts = make(chan *client.Series)
+}
+
+func Test_SpoolKeepsFailedBatch(t *testing.T) {
+	defer func(s *Spool, c *client.Client, w time.Duration, r int, d string) {
+		spool, cl, AsyncMaxWait, AsyncRetries, path_deadletter = s, c, w, r, d
+	}(spool, cl, AsyncMaxWait, AsyncRetries, path_deadletter)
+	var down int32 = 1
+	var mu sync.Mutex
+	written := make([]string, 0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "server down", http.StatusServiceUnavailable)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		written = append(written, string(data))
+		mu.Unlock()
+	}))
+	defer ts.Close()
+	var err error
+	cl, err = client.NewClient(&client.ClientConfig{Host: strings.TrimPrefix(ts.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "influx-cli-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err = OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	// the dead letter file can't be written either
+	path_deadletter = filepath.Join(dir, "missing", "deadletter")
+	AsyncMaxWait, AsyncRetries = time.Hour, 0
+	go committer()
+
+	a := &client.Series{Name: "a", Columns: []string{"value"}, Points: [][]interface{}{{json.Number("1")}}}
+	b := &client.Series{Name: "b", Columns: []string{"value"}, Points: [][]interface{}{{json.Number("2")}}}
+	if err := queueAsync(a); err != nil {
+		t.Fatal(err)
+	}
+	forceInsertsFlush <- true
+	// the committer only picks up b once the failed commit of a is done
+	if err := queueAsync(b); err != nil {
+		t.Fatal(err)
+	}
+	series, _ := spool.ReadAll()
+	if len(series) != 2 {
+		t.Errorf("expected a and b in the spool, got %v", spew.Sdump(series))
+	}
+
+	atomic.StoreInt32(&down, 0)
+	close(asyncInserts)
+	<-asyncInsertsCommitted
+	asyncInserts = make(chan *client.Series)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(written) != 1 || !strings.Contains(written[0], `"name":"a"`) || !strings.Contains(written[0], `"name":"b"`) {
+		t.Errorf("expected a and b to be written together, got %v", written)
+	}
+	series, _ = spool.ReadAll()
+	if len(series) != 0 {
+		t.Errorf("expected an empty spool once everything is written, got %v", spew.Sdump(series))
+	}
+}
+
+func Test_MetricsOutConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx-cli-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "metrics.json")
+	w, err := newMetricsWriter(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := metrics.NewRegistry()
+	for i := 0; i < 50; i++ {
+		metrics.GetOrRegisterCounter("counter_"+strconv.Itoa(i), r).Inc(int64(i))
+	}
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			w(r, time.Now())
+			done <- true
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	data, _ := ioutil.ReadFile(file)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 10 {
+		t.Fatalf("expected 10 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &doc); err != nil {
+			t.Errorf("interleaved write: %s", err.Error())
+		}
+	}
+}
+
+func Test_SwitchProfile(t *testing.T) {
+	defer func(h string, p int, u, pw, d string, ps map[string]Profile, b Profile, pr string) {
+		host, port, user, pass, db, profiles, baseConn, profile = h, p, u, pw, d, ps, b, pr
+	}(host, port, user, pass, db, profiles, baseConn, profile)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	h, p, _ := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	tsPort, _ := strconv.Atoi(p)
+
+	baseConn = Profile{Host: h, Port: tsPort, User: "root", Pass: "root", Db: ""}
+	profiles = map[string]Profile{
+		"production": {User: "admin", Pass: "prodpass", Db: "prod"},
+		"staging":    {Db: "staging"},
+	}
+	if err := switchProfile("production"); err != nil {
+		t.Fatal(err)
+	}
+	if err := switchProfile("staging"); err != nil {
+		t.Fatal(err)
+	}
+	if user != "root" || pass != "root" || db != "staging" || profile != "staging" {
+		t.Errorf("expected staging to start from the base parameters, got user %q pass %q db %q", user, pass, db)
+	}
+}
+
+func Test_SaveRcQuoting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx-cli-rc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p, h, u, pw, d string) { path_rc, host, user, pass, db = p, h, u, pw, d }(path_rc, host, user, pass, db)
+	path_rc = filepath.Join(dir, "influxrc")
+
+	// as loaded from an rc file
+	host, user, pass, db = "localhost", `we"ird\user`, url.QueryEscape(`a&b"c\d`), "db"
+	if err := saveRc("", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var conf Config
+	if _, err := toml.DecodeFile(path_rc, &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.User != `we"ird\user` || conf.Pass != `a&b"c\d` {
+		t.Errorf("values didn't survive the round trip: user %q pass %q", conf.User, conf.Pass)
+	}
+
+	// control characters, for which strconv.Quote would write escapes toml doesn't know (\a, \x01)
+	pass = url.QueryEscape("p\a\x01\t\x7fé")
+	if err := saveRc("", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	conf = Config{}
+	if _, err := toml.DecodeFile(path_rc, &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Pass != "p\a\x01\t\x7fé" {
+		t.Errorf("pass didn't survive the round trip: %q", conf.Pass)
+	}
+}
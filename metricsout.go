@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rcrowley/go-metrics"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefix for the metric names we send to graphite
+var graphitePrefix = "influx-cli"
+
+// a MetricsWriter writes a snapshot of the registry somewhere
+type MetricsWriter func(r metrics.Registry, now time.Time) error
+
+// newMetricsWriter returns a writer for -metrics-out:
+// tcp://host:port sends graphite plaintext, anything else is a file we append json lines to.
+// the writer is safe to call concurrently (the ticker and the final export in Exit), writes don't interleave.
+func newMetricsWriter(out string) (MetricsWriter, error) {
+	var mu sync.Mutex
+	if strings.HasPrefix(out, "tcp://") {
+		addr := strings.TrimPrefix(out, "tcp://")
+		return func(r metrics.Registry, now time.Time) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return writeGraphite(addr, r, now)
+		}, nil
+	}
+	fd, err := os.OpenFile(Expand(out), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return func(r metrics.Registry, now time.Time) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return writeMetricsJson(fd, r, now)
+	}, nil
+}
+
+// exportMetrics writes the registry every interval, until the process exits
+func exportMetrics(w MetricsWriter, r metrics.Registry, interval time.Duration) {
+	for now := range time.Tick(interval) {
+		err := w(r, now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not export metrics: %s\n", err.Error())
+		}
+	}
+}
+
+// metricValues returns the values we export for a metric, by field name.
+// timer values are in milliseconds, rates are per second averaged since startup.
+func metricValues(i interface{}) map[string]float64 {
+	s, ok := summarize(i)
+	if !ok {
+		return nil
+	}
+	values := map[string]float64{"count": float64(s.Count)}
+	if s.Type == "counter" {
+		return values
+	}
+	unit := 1.0
+	if s.Type == "timer" {
+		unit = float64(time.Millisecond)
+		values["rate"] = s.Rate
+	}
+	values["mean"] = s.Mean / unit
+	values["p50"] = s.P50 / unit
+	values["p95"] = s.P95 / unit
+	values["p99"] = s.P99 / unit
+	return values
+}
+
+// writeGraphite sends one "<prefix>.<metric>.<field> <value> <timestamp>" line per value
+func writeGraphite(addr string, r metrics.Registry, now time.Time) error {
+	var buf bytes.Buffer
+	r.Each(func(name string, i interface{}) {
+		values := metricValues(i)
+		fields := make([]string, 0, len(values))
+		for field := range values {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			fmt.Fprintf(&buf, "%s.%s.%s %s %d\n", graphitePrefix, name, field, valueString(values[field]), now.Unix())
+		}
+	})
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return conn.Close()
+}
+
+// writeMetricsJson writes the registry as one json object, on its own line
+func writeMetricsJson(fd *os.File, r metrics.Registry, now time.Time) error {
+	all := make(map[string]map[string]float64)
+	r.Each(func(name string, i interface{}) {
+		if values := metricValues(i); values != nil {
+			all[name] = values
+		}
+	})
+	data, err := json.Marshal(map[string]interface{}{"time": now.Unix(), "metrics": all})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fd, "%s\n", data)
+	return err
+}
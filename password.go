@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/andrew-d/go-termutil"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// alternatives to -pass, which leaks the password into ps and the shell history
+var passFile string
+var passPrompt bool
+
+// readPassFile returns the password stored in the given file, without trailing newline
+func readPassFile(file string) (string, error) {
+	data, err := ioutil.ReadFile(Expand(file))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// promptPass reads the password from the terminal without echoing it.
+// we use the terminal directly, so this works even when queries are piped into stdin.
+func promptPass() (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", errors.New("-pass-prompt needs a terminal: " + err.Error())
+	}
+	defer tty.Close()
+	p, err := termutil.GetPass("Password: ", tty.Fd(), tty.Fd())
+	if err != nil {
+		return "", err
+	}
+	return string(p), nil
+}
+
+// resolveConn applies what comes after the influxrc in the precedence chain:
+// the INFLUX_PASSWORD environment variable, the selected profile, and then -pass, -pass-file or -pass-prompt.
+// explicit holds the flags that were set on the commandline.
+func resolveConn(explicit map[string]bool) error {
+	sources := 0
+	for _, name := range []string{"pass", "pass-file", "pass-prompt"} {
+		if explicit[name] {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.New("only one of -pass, -pass-file and -pass-prompt can be used")
+	}
+	// the env var sits between the rc file and the profiles, also when switching profiles later on
+	if env := os.Getenv("INFLUX_PASSWORD"); env != "" {
+		baseConn.Pass = url.QueryEscape(env)
+		if sources == 0 {
+			pass = baseConn.Pass
+		}
+	}
+	if profile != "" {
+		p, ok := profiles[profile]
+		if !ok {
+			return fmt.Errorf("unknown profile %q. available: %s", profile, strings.Join(profileNames(), ", "))
+		}
+		applyProfile(p, explicit)
+	}
+	if passFile != "" {
+		p, err := readPassFile(passFile)
+		if err != nil {
+			return err
+		}
+		pass = url.QueryEscape(p)
+	}
+	if passPrompt {
+		p, err := promptPass()
+		if err != nil {
+			return err
+		}
+		pass = url.QueryEscape(p)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Profile is a named set of connection parameters, from a [profiles.<name>] table in the rc file
+type Profile struct {
+	Host string
+	Port int
+	User string
+	Pass string
+	Db   string
+}
+
+var profiles map[string]Profile
+var profile string // name of the active profile, if any
+
+// the connection parameters from the defaults and the top level of the rc file.
+// switching profiles starts from these, so nothing leaks over from the previous profile.
+// (pass is url-escaped, like the pass we use)
+var baseConn Profile
+
+var reProfileName = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+var reRcTable = regexp.MustCompile("^\\s*\\[")
+var reRcKey = regexp.MustCompile("^\\s*([a-zA-Z0-9_-]+)\\s*=")
+
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile sets the connection parameters from the profile,
+// except those in skip, which were set explicitly.
+func applyProfile(p Profile, skip map[string]bool) {
+	if p.Host != "" && !skip["host"] {
+		host = p.Host
+	}
+	if p.Port != 0 && !skip["port"] {
+		port = p.Port
+	}
+	if p.User != "" && !skip["user"] {
+		user = p.User
+	}
+	if p.Pass != "" && !skip["pass"] {
+		pass = url.QueryEscape(p.Pass)
+	}
+	if p.Db != "" && !skip["db"] {
+		db = p.Db
+	}
+}
+
+// switchProfile makes the named profile active, and connects using it
+func switchProfile(name string) error {
+	p, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q. available: %s", name, strings.Join(profileNames(), ", "))
+	}
+	host, port, user, pass, db = baseConn.Host, baseConn.Port, baseConn.User, baseConn.Pass, baseConn.Db
+	applyProfile(p, nil)
+	profile = name
+	return getClient()
+}
+
+// rcSection returns the line range [start, end) of the given table in the rc file.
+// the empty name is the top level, before the first table. ok is false if the table doesn't exist.
+func rcSection(lines []string, name string) (start, end int, ok bool) {
+	start = -1
+	if name == "" {
+		start = 0
+	}
+	for i, line := range lines {
+		if !reRcTable.MatchString(line) {
+			continue
+		}
+		if start >= 0 {
+			return start, i, true
+		}
+		if strings.TrimSpace(line) == "["+name+"]" {
+			start = i + 1
+		}
+	}
+	if start < 0 {
+		return 0, 0, false
+	}
+	return start, len(lines), true
+}
+
+// setRcKeys sets the given keys (in order) in a table of the rc file, leaving everything else alone.
+// existing keys are updated in place, missing ones are added to the end of the table,
+// and the table is created if it doesn't exist yet.
+func setRcKeys(rc string, table string, keys []string, values map[string]string) string {
+	lines := strings.Split(strings.TrimRight(rc, "\n"), "\n")
+	if rc == "" {
+		lines = []string{}
+	}
+	start, end, ok := rcSection(lines, table)
+	if !ok {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "["+table+"]")
+		start, end = len(lines), len(lines)
+	}
+	missing := make([]string, 0)
+	for _, key := range keys {
+		found := false
+		for i := start; i < end; i++ {
+			if m := reRcKey.FindStringSubmatch(lines[i]); m != nil && m[1] == key {
+				lines[i] = key + " = " + values[key]
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, key+" = "+values[key])
+		}
+	}
+	// add missing keys after the last non-blank line of the table
+	at := end
+	for at > start && strings.TrimSpace(lines[at-1]) == "" {
+		at--
+	}
+	out := make([]string, 0, len(lines)+len(missing))
+	out = append(out, lines[:at]...)
+	out = append(out, missing...)
+	out = append(out, lines[at:]...)
+	return strings.Join(out, "\n") + "\n"
+}
+
+// saveRc writes the current connection parameters to the rc file, as the given profile,
+// or at the top level if name is empty.
+// the file contains passwords, so only we should be able to read it. if it was more open than that,
+// we restrict it, and warn on out.
+func saveRc(name string, out io.Writer) error {
+	rc, err := ioutil.ReadFile(path_rc)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if info, err := os.Stat(path_rc); err == nil && info.Mode().Perm()&0077 != 0 {
+		fmt.Fprintf(out, "warning: %s had permissions %#o, which lets others read your passwords. changing them to 0600\n", path_rc, info.Mode().Perm())
+		err = os.Chmod(path_rc, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	table := ""
+	if name != "" {
+		if !reProfileName.MatchString(name) {
+			return errors.New("profile names can only contain letters, digits, _ and -")
+		}
+		table = "profiles." + name
+	}
+	// pass is url-escaped when we load it, so store the original
+	rawPass, err := url.QueryUnescape(pass)
+	if err != nil {
+		rawPass = pass
+	}
+	values := map[string]string{
+		"host": tomlQuote(host),
+		"port": strconv.Itoa(port),
+		"user": tomlQuote(user),
+		"pass": tomlQuote(rawPass),
+		"db":   tomlQuote(db),
+	}
+	keys := []string{"host", "port", "user", "pass", "db"}
+	return ioutil.WriteFile(path_rc, []byte(setRcKeys(string(rc), table, keys, values)), 0600)
+}
+
+// tomlQuote returns s as a toml basic string. unlike strconv.Quote, it only uses the escapes toml knows:
+// the short ones, and \uXXXX for other control characters. everything else is written as is.
+func tomlQuote(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString("\\\"")
+		case '\\':
+			buf.WriteString("\\\\")
+		case '\b':
+			buf.WriteString("\\b")
+		case '\t':
+			buf.WriteString("\\t")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\f':
+			buf.WriteString("\\f")
+		case '\r':
+			buf.WriteString("\\r")
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&buf, "\\u%04X", r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
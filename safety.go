@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gobs/readline"
+	"strings"
+)
+
+// assumeYes skips the confirmation of destructive commands.
+// in safe mode, destructive commands are refused altogether.
+var assumeYes bool
+var safe bool
+
+// interactive is true while we execute commands typed at the prompt (or given on the commandline from a terminal).
+// commands from scripts and piped stdin are never confirmed, there's nobody to answer.
+var interactive bool
+
+// confirmDestructive asks the user to confirm a destructive command, by typing the name of
+// the object it applies to.
+func confirmDestructive(action, name string) error {
+	return confirm(action, name, readAnswer, interactive)
+}
+
+// readAnswer reads a line through readline, which owns the terminal, so we don't steal input
+// that was typed or pasted ahead. ok is false on ctrl-D.
+func readAnswer(prompt string) (answer string, ok bool) {
+	line := readline.ReadLine(&prompt)
+	if line == nil {
+		fmt.Println("")
+		return "", false
+	}
+	return *line, true
+}
+
+func confirm(action, name string, ask func(prompt string) (string, bool), interactive bool) error {
+	if safe {
+		return fmt.Errorf("refusing to %s %s in safe mode. use \\safe to unlock", action, name)
+	}
+	if assumeYes || !interactive {
+		return nil
+	}
+	answer, _ := ask(fmt.Sprintf("this will %s %s, which can't be undone. type %q to confirm: ", action, name, name))
+	if strings.TrimSpace(answer) != name {
+		return fmt.Errorf("not confirmed. did not %s %s", action, name)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/influxdb/influxdb/client"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// spoolDir is where the spool lives, if enabled
+var spoolDir string
+
+// Spool is an on-disk write-ahead log for async inserts.
+// the committer appends (and syncs) every insert it receives before it's acknowledged, and truncates the spool
+// once all pending inserts are written (or moved to the dead letter file). inserts that could be neither,
+// stay in the spool, and are retried with the next batch before it's truncated.
+// whatever is left in the spool when we start, didn't make it, and is resent.
+type Spool struct {
+	path string
+	fd   *os.File
+}
+
+func OpenSpool(dir string) (*Spool, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "async.spool")
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// another instance would truncate our pending inserts, and we'd resend theirs
+	err = lockFile(fd)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("%s is in use by another influx-cli: %s", path, err.Error())
+	}
+	return &Spool{path, fd}, nil
+}
+
+// Append writes the serie to the spool, as one line of json, and syncs it to disk
+func (s *Spool) Append(serie *client.Series) error {
+	data, err := json.Marshal(serie)
+	if err != nil {
+		return err
+	}
+	_, err = s.fd.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return s.fd.Sync()
+}
+
+func (s *Spool) Close() error {
+	return s.fd.Close()
+}
+
+func (s *Spool) Truncate() error {
+	return s.fd.Truncate(0)
+}
+
+// ReadAll returns all series in the spool
+func (s *Spool) ReadAll() ([]*client.Series, error) {
+	_, err := s.fd.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	series := make([]*client.Series, 0)
+	reader := bufio.NewReader(s.fd)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a partial last line means we crashed halfway writing it. it was never acknowledged
+			return series, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var serie client.Series
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&serie); err != nil {
+			return nil, fmt.Errorf("%s: %s", s.path, err.Error())
+		}
+		series = append(series, &serie)
+	}
+}
+
+// recoverSpool resends whatever inserts were left in the spool by a previous run.
+// those that still fail go to the dead letter file.
+func recoverSpool(s *Spool) error {
+	series, err := s.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(series) == 0 {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "resending %d async inserts left in %s\n", len(series), s.path)
+	for start := 0; start < len(series); start += AsyncCapacity {
+		end := start + AsyncCapacity
+		if end > len(series) {
+			end = len(series)
+		}
+		batch := series[start:end]
+		err = writeWithRetry(batch, asyncPrecision)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write %d series: %s\n", len(batch), err.Error())
+			err = writeDeadLetter(batch, asyncPrecision)
+			if err != nil {
+				// keep the spool as is, so we can try again next time
+				return fmt.Errorf("Could not write them to dead letter file %s: %s", path_deadletter, err.Error())
+			}
+			fmt.Fprintf(os.Stderr, "Wrote them to %s. use 'replay deadletter' to resend them\n", path_deadletter)
+		}
+	}
+	return s.Truncate()
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import (
+	"os"
+)
+
+// lockFile is a no-op where we don't have flock. don't share a spoolDir between instances there.
+func lockFile(fd *os.File) error {
+	return nil
+}
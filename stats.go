@@ -0,0 +1,129 @@
+package main
+
+import (
+	"github.com/influxdb/influxdb/client"
+	"github.com/rcrowley/go-metrics"
+	"math"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// handlerName returns the name of a handler function, e.g. selectHandler -> "select"
+func handlerName(h Handler) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.TrimSuffix(name, "Handler")
+}
+
+// statsName names the command a spec matched, for its counters: its keywords, like "list_series",
+// or for options, the option, like "option_format". all options share one spec, but they're different commands.
+func statsName(spec HandlerSpec, matches []string) string {
+	if spec.Match == regexOption {
+		return "option_" + matches[1]
+	}
+	name := keywordOf(spec.Match)
+	if name == "" {
+		name = handlerName(spec.Handler)
+	}
+	return strings.Replace(name, " ", "_", -1)
+}
+
+// countHandler tracks how often a command ran, and how often it failed
+func countHandler(name string, err error) {
+	metrics.GetOrRegisterCounter("handler_"+name+"_calls", metrics.DefaultRegistry).Inc(1)
+	if err != nil {
+		metrics.GetOrRegisterCounter("handler_"+name+"_errors", metrics.DefaultRegistry).Inc(1)
+	}
+}
+
+// countRefused tracks how often a command was refused (in read-only mode) without running
+func countRefused(name string) {
+	metrics.GetOrRegisterCounter("handler_"+name+"_refused", metrics.DefaultRegistry).Inc(1)
+}
+
+// countQuery tracks the number of queries run and rows they returned
+func countQuery(series []*client.Series) {
+	rows := 0
+	for _, serie := range series {
+		rows += len(serie.Points)
+	}
+	metrics.GetOrRegisterCounter("queries", metrics.DefaultRegistry).Inc(1)
+	metrics.GetOrRegisterCounter("rows_returned", metrics.DefaultRegistry).Inc(int64(rows))
+}
+
+func round2(f float64) float64 {
+	return math.Floor(f*100+0.5) / 100
+}
+
+// timers hold nanoseconds, which we show as durations
+func formatDuration(ns float64) string {
+	return time.Duration(ns).String()
+}
+
+// metricSummary holds the values we show (\stats) and export (-metrics-out) for a metric.
+// counters only have a count, histograms have no rate.
+// timer values are in nanoseconds, rates are per second, averaged since startup.
+type metricSummary struct {
+	Type          string
+	Count         int64
+	Mean          float64
+	P50, P95, P99 float64
+	Rate          float64
+}
+
+// summarize takes a snapshot of a counter, timer or histogram. ok is false for other metrics.
+func summarize(i interface{}) (s metricSummary, ok bool) {
+	switch m := i.(type) {
+	case metrics.Counter:
+		return metricSummary{Type: "counter", Count: m.Count()}, true
+	case metrics.Timer:
+		t := m.Snapshot()
+		ps := t.Percentiles([]float64{0.5, 0.95, 0.99})
+		return metricSummary{"timer", t.Count(), t.Mean(), ps[0], ps[1], ps[2], t.RateMean()}, true
+	case metrics.Histogram:
+		h := m.Snapshot()
+		ps := h.Percentiles([]float64{0.5, 0.95, 0.99})
+		return metricSummary{Type: "histogram", Count: h.Count(), Mean: h.Mean(), P50: ps[0], P95: ps[1], P99: ps[2]}, true
+	}
+	return metricSummary{}, false
+}
+
+// statsSeries renders all timers, histograms and counters in the registry,
+// one row per metric, sorted by name. values that don't apply are nil.
+// rates are per second, averaged since startup.
+func statsSeries(r metrics.Registry) *client.Series {
+	names := make([]string, 0)
+	all := make(map[string]interface{})
+	r.Each(func(name string, i interface{}) {
+		names = append(names, name)
+		all[name] = i
+	})
+	sort.Strings(names)
+	serie := &client.Series{
+		Name:    "stats",
+		Columns: []string{"name", "type", "count", "mean", "p50", "p95", "p99", "rate"},
+		Points:  make([][]interface{}, 0, len(names)),
+	}
+	for _, name := range names {
+		s, ok := summarize(all[name])
+		if !ok {
+			continue
+		}
+		switch s.Type {
+		case "counter":
+			serie.Points = append(serie.Points, []interface{}{name, s.Type, s.Count, nil, nil, nil, nil, nil})
+		case "timer":
+			serie.Points = append(serie.Points, []interface{}{name, s.Type, s.Count, formatDuration(s.Mean),
+				formatDuration(s.P50), formatDuration(s.P95), formatDuration(s.P99), round2(s.Rate)})
+		case "histogram":
+			serie.Points = append(serie.Points, []interface{}{name, s.Type, s.Count, round2(s.Mean),
+				round2(s.P50), round2(s.P95), round2(s.P99), nil})
+		}
+	}
+	return serie
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/influxdb/influxdb/client"
+	"github.com/mattn/go-runewidth"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Table renders rows of cells as aligned columns.
+// widths are measured in terminal cells, so wide (e.g. CJK) characters line up too.
+// columns that only contain numbers are right-aligned, all others left-aligned.
+type Table struct {
+	Header []string
+	Rows   [][]string
+	Border bool
+}
+
+func NewTable(header []string) *Table {
+	return &Table{Header: header, Rows: make([][]string, 0)}
+}
+
+func (t *Table) AddRow(cells []string) {
+	t.Rows = append(t.Rows, cells)
+}
+
+func (t *Table) numCols() int {
+	n := len(t.Header)
+	for _, row := range t.Rows {
+		if len(row) > n {
+			n = len(row)
+		}
+	}
+	return n
+}
+
+func (t *Table) widths() []int {
+	widths := make([]int, t.numCols())
+	for i, cell := range t.Header {
+		widths[i] = runewidth.StringWidth(cell)
+	}
+	for _, row := range t.Rows {
+		for i, cell := range row {
+			if w := runewidth.StringWidth(cell); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+	return widths
+}
+
+func isNumeric(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+func (t *Table) rightAligned() []bool {
+	right := make([]bool, t.numCols())
+	for i := range right {
+		right[i] = len(t.Rows) > 0
+	}
+	for _, row := range t.Rows {
+		for i := range right {
+			if i < len(row) && row[i] != "" && !isNumeric(row[i]) {
+				right[i] = false
+			}
+		}
+	}
+	return right
+}
+
+func (t *Table) line(cells []string, widths []int, right []bool) string {
+	padded := make([]string, len(widths))
+	for i, w := range widths {
+		cell := ""
+		if i < len(cells) {
+			cell = cells[i]
+		}
+		if right[i] {
+			padded[i] = runewidth.FillLeft(cell, w)
+		} else {
+			padded[i] = runewidth.FillRight(cell, w)
+		}
+	}
+	if t.Border {
+		return "| " + strings.Join(padded, " | ") + " |\n"
+	}
+	// no point in padding the last column with trailing whitespace
+	return strings.TrimRight(strings.Join(padded, "  "), " ") + "\n"
+}
+
+func (t *Table) separator(widths []int) string {
+	dashes := make([]string, len(widths))
+	for i, w := range widths {
+		dashes[i] = strings.Repeat("-", w+2)
+	}
+	return "+" + strings.Join(dashes, "+") + "+\n"
+}
+
+// Render writes the table to out. the header is omitted if showHeader is false
+func (t *Table) Render(out io.Writer, showHeader bool) error {
+	widths := t.widths()
+	right := t.rightAligned()
+	var buf bytes.Buffer
+	if t.Border {
+		buf.WriteString(t.separator(widths))
+	}
+	if showHeader {
+		buf.WriteString(t.line(t.Header, widths, make([]bool, len(widths))))
+		if t.Border {
+			buf.WriteString(t.separator(widths))
+		}
+	}
+	for _, row := range t.Rows {
+		buf.WriteString(t.line(row, widths, right))
+	}
+	if t.Border && (len(t.Rows) > 0 || !showHeader) {
+		buf.WriteString(t.separator(widths))
+	}
+	_, err := io.WriteString(out, buf.String())
+	return err
+}
+
+// printTable renders a series as a table, honoring the border and records-only settings
+func printTable(out io.Writer, serie *client.Series) error {
+	t := NewTable(serie.Columns)
+	t.Border = border
+	for _, p := range serie.Points {
+		row := make([]string, len(p))
+		for i, v := range p {
+			row[i] = valueString(v)
+		}
+		t.AddRow(row)
+	}
+	return t.Render(out, !recordsOnly)
+}
+
+// printVertical renders a series in expanded mode: each point becomes a block
+// of "column | value" lines, preceded by a separator with series name and row number
+func printVertical(out io.Writer, serie *client.Series) error {
+	width := 0
+	for _, col := range serie.Columns {
+		if w := runewidth.StringWidth(col); w > width {
+			width = w
+		}
+	}
+	var buf bytes.Buffer
+	for i, p := range serie.Points {
+		fmt.Fprintf(&buf, "*** %s: row %d ***\n", serie.Name, i+1)
+		for j, col := range serie.Columns {
+			val := ""
+			if j < len(p) {
+				val = valueString(p[j])
+			}
+			fmt.Fprintf(&buf, "%s | %s\n", runewidth.FillRight(col, width), val)
+		}
+	}
+	_, err := out.Write(buf.Bytes())
+	return err
+}
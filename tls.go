@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// tls settings, only used when ssl is enabled
+var ssl bool
+var caCert string
+var clientCert, clientKey string
+var insecureSkipVerify bool
+
+// newTlsConfig builds the tls config for https connections from the tls settings
+func newTlsConfig() (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(Expand(caCert))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caCert)
+		}
+		conf.RootCAs = pool
+	}
+	if (clientCert == "") != (clientKey == "") {
+		return nil, errors.New("client-cert and client-key must be set together")
+	}
+	if clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(Expand(clientCert), Expand(clientKey))
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+func newHttpsClient() (*http.Client, error) {
+	conf, err := newTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: conf,
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/influxdb/influxdb/client"
+	"strconv"
+)
+
+// when udp is enabled, inserts are sent to the server's udp listener on udpPort.
+// the server interprets times in ms, and writes to the database it was configured with.
+var udpPort int
+var udp bool
+var udpCl *client.Client
+
+var udpPrecision = client.Millisecond
+
+// getUdpClient sets up the client for udp inserts, if we have a udp port
+func getUdpClient() error {
+	udpCl = nil
+	if udpPort == 0 {
+		return nil
+	}
+	var err error
+	udpCl, err = client.NewClient(&client.ClientConfig{
+		Host:     fmt.Sprintf("%s:%d", host, udpPort),
+		Username: user,
+		Password: pass,
+		Database: db,
+		IsUDP:    true,
+	})
+	return err
+}
+
+// writeSeries writes the series over udp or http, depending on the udp setting
+func writeSeries(series []*client.Series, precision client.TimePrecision) error {
+	if udp {
+		udpSeries, err := toUdpPrecision(series, precision)
+		if err != nil {
+			return err
+		}
+		datagrams, err := udpDatagrams(udpSeries)
+		if err != nil {
+			return err
+		}
+		for _, datagram := range datagrams {
+			err = udpCl.WriteSeriesOverUDP(datagram)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return cl.WriteSeriesWithTimePrecision(series, precision)
+}
+
+// udpMaxMessageSize mirrors the client's UDPMaxMessageSize: it refuses payloads of this size or more
+var udpMaxMessageSize = 2048
+
+// udpDatagrams splits the series into payloads that each fit in one udp message.
+// points of the same series stay together as much as possible.
+// we track the exact size of the json encoding as we go, rather than encoding every candidate payload.
+func udpDatagrams(series []*client.Series) ([][]*client.Series, error) {
+	datagrams := make([][]*client.Series, 0, 1)
+	var current []*client.Series
+	size := 2 // "[]"
+	for _, serie := range series {
+		header, err := json.Marshal(&client.Series{Name: serie.Name, Columns: serie.Columns, Points: [][]interface{}{}})
+		if err != nil {
+			return nil, err
+		}
+		var last *client.Series // the copy of serie in the current datagram, if any
+		for _, p := range serie.Points {
+			point, err := json.Marshal(p)
+			if err != nil {
+				return nil, err
+			}
+			if 2+len(header)+len(point) >= udpMaxMessageSize {
+				return nil, fmt.Errorf("a point of series %s is too large to send over udp", serie.Name)
+			}
+			extra := len(point) + 1 // comma between points
+			if last == nil {
+				extra = len(header) + len(point)
+				if len(current) > 0 {
+					extra++ // comma between series
+				}
+			}
+			if size+extra >= udpMaxMessageSize {
+				datagrams = append(datagrams, current)
+				current, last = nil, nil
+				size = 2
+				extra = len(header) + len(point)
+			}
+			if last == nil {
+				last = &client.Series{Name: serie.Name, Columns: serie.Columns, Points: [][]interface{}{}}
+				current = append(current, last)
+			}
+			last.Points = append(last.Points, p)
+			size += extra
+		}
+	}
+	if len(current) > 0 {
+		datagrams = append(datagrams, current)
+	}
+	return datagrams, nil
+}
+
+// toUdpPrecision returns a copy of the series with their times converted to udpPrecision
+func toUdpPrecision(series []*client.Series, precision client.TimePrecision) ([]*client.Series, error) {
+	converted := make([]*client.Series, len(series))
+	for i, serie := range series {
+		timeCol := -1
+		for j, col := range serie.Columns {
+			if col == "time" {
+				timeCol = j
+			}
+		}
+		converted[i] = serie
+		if timeCol == -1 || precision == udpPrecision {
+			continue
+		}
+		points := make([][]interface{}, len(serie.Points))
+		for j, p := range serie.Points {
+			ts, err := timeInt(p[timeCol])
+			if err != nil {
+				return nil, fmt.Errorf("invalid time in series %s: %s", serie.Name, err.Error())
+			}
+			points[j] = make([]interface{}, len(p))
+			copy(points[j], p)
+			points[j][timeCol] = convertTime(ts, precision, udpPrecision)
+		}
+		converted[i] = &client.Series{Name: serie.Name, Columns: serie.Columns, Points: points}
+	}
+	return converted, nil
+}
+
+// timeInt returns a time value as an int64, whether it came from an insert, or was decoded from json
+func timeInt(v interface{}) (int64, error) {
+	switch val := v.(type) {
+	case int64:
+		return val, nil
+	case float64:
+		return int64(val), nil
+	case json.Number:
+		return val.Int64()
+	case string:
+		return strconv.ParseInt(val, 10, 64)
+	}
+	return 0, fmt.Errorf("%v is not a timestamp", v)
+}